@@ -0,0 +1,495 @@
+/*
+
+maryo/access.go
+
+keeps the proxy from being used by anything but the consoles
+it is meant for: which clients can connect, logging in, and
+how many requests each one can make
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long a client's rate limit is kept after its last request
+const rateLimitForget = time.Minute
+
+// metrics for access control
+var (
+	clientsRefused     = newCounter("maryo_clients_refused_total", "connections refused because the client isn't in allowedClients")
+	proxyAuthFailures  = newCounter("maryo_proxy_auth_failures_total", "proxy requests refused for a missing or wrong login")
+	rateLimitedClients = newCounter("maryo_rate_limited_total", "requests refused because the client went over its rate limit")
+)
+
+// how many requests a client has left, refilled over time
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// who can use the proxy, and how much
+type accessControl struct {
+	allowed  []*net.IPNet
+	user     string
+	password string
+	rate     float64
+	burst    float64
+	lock     sync.Mutex
+	buckets  map[string]*rateBucket
+	warned   map[string]bool
+}
+
+// get the networks of this machine, which the consoles are
+// usually on, and loopback
+func localNetworks() []*net.IPNet {
+
+	// loopback is always there
+	_, loop4, _ := net.ParseCIDR("127.0.0.0/8")
+	_, loop6, _ := net.ParseCIDR("::1/128")
+	networks := []*net.IPNet{loop4, loop6}
+
+	// add the network of each address
+	addresses, _ := listAddresses()
+	for _, addr := range addresses {
+
+		// add it
+		networks = append(networks, &net.IPNet{IP: addr.ip.Mask(addr.mask), Mask: addr.mask})
+
+	}
+
+	// return them
+	return networks
+
+}
+
+// read a list of ips and cidrs
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+
+	// list of networks
+	networks := []*net.IPNet{}
+	for _, entry := range entries {
+
+		// it can be a cidr
+		if strings.Contains(entry, "/") {
+
+			// parse it
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+
+				// it is wrong
+				return nil, fmt.Errorf("%s isn't an ip or cidr", entry)
+
+			}
+			networks = append(networks, network)
+			continue
+
+		}
+
+		// or just an ip
+		ip := net.ParseIP(entry)
+		if ip == nil {
+
+			// it is wrong
+			return nil, fmt.Errorf("%s isn't an ip or cidr", entry)
+
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+
+			// it is shorter
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+
+		}
+		networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+	}
+
+	// return them
+	return networks, nil
+
+}
+
+// make the access control from the settings in the config
+func accessControlFromConfig(configData map[string]interface{}) (*accessControl, error) {
+
+	// make it
+	access := &accessControl{
+
+		allowed:  localNetworks(),
+		user:     getSetting(configData, "proxyUser", ""),
+		password: getSetting(configData, "proxyPassword", ""),
+		buckets:  make(map[string]*rateBucket),
+		warned:   make(map[string]bool),
+	}
+
+	// a password does nothing without a user to go with it
+	if (access.password != "") && (access.user == "") {
+
+		// it is wrong
+		return nil, fmt.Errorf("proxyPassword is set, but proxyUser isn't, so nothing would ask for a login")
+
+	}
+
+	// get the clients that can connect, if they are set
+	if entries := getListSetting(configData, "allowedClients"); len(entries) != 0 {
+
+		// read them
+		allowed, err := parseNetworks(entries)
+		if err != nil {
+
+			// return the error
+			return nil, fmt.Errorf("allowedClients is wrong: %s", err.Error())
+
+		}
+		access.allowed = allowed
+
+	}
+
+	// get the rate limit
+	rate, err := strconv.ParseFloat(getSetting(configData, "rateLimit", "0"), 64)
+	if (err != nil) || (rate < 0) {
+
+		// it is wrong
+		return nil, fmt.Errorf("rateLimit must be a number of requests per second (or 0 for no limit)")
+
+	}
+	access.rate = rate
+	burst, err := strconv.ParseFloat(getSetting(configData, "rateBurst", strconv.FormatFloat(math.Max(2*rate, 1), 'f', -1, 64)), 64)
+	if (err != nil) || (burst < 1) {
+
+		// it is wrong
+		return nil, fmt.Errorf("rateBurst must be a number of requests, at least 1")
+
+	}
+	access.burst = burst
+
+	// return it
+	return access, nil
+
+}
+
+// show what the access control does
+func (access *accessControl) describe() {
+
+	// which clients can connect
+	networks := []string{}
+	for _, network := range access.allowed {
+
+		// add it
+		networks = append(networks, network.String())
+
+	}
+	consoleSequence(fmt.Sprintf("-> allowing clients from %s%s%s\n", code("grey"), strings.Join(networks, ", "), code("reset")))
+	writeLog(fmt.Sprintf("-> allowing clients from %s\n", strings.Join(networks, ", ")))
+
+	// if a login is needed
+	if access.user != "" {
+
+		// let the user know
+		consoleSequence(fmt.Sprintf("-> the proxy needs a login, as %s%s%s\n", code("green"), access.user, code("reset")))
+
+	}
+
+	// and how fast clients can go
+	if access.rate > 0 {
+
+		// let the user know
+		consoleSequence(fmt.Sprintf("-> limiting each client to %s%g%s request(s) a second\n", code("green"), access.rate, code("reset")))
+
+	}
+
+}
+
+// get the ip of a client from its address
+func clientIP(addr string) net.IP {
+
+	// strip the port
+	return net.ParseIP(stripHostPort(addr))
+
+}
+
+// check if a client can connect, logging it the first time it can't
+func (access *accessControl) allows(addr net.Addr) bool {
+
+	// check the networks
+	ip := clientIP(addr.String())
+	if ip != nil {
+
+		// check each one
+		for _, network := range access.allowed {
+
+			// check it
+			if network.Contains(ip) {
+
+				// it can
+				return true
+
+			}
+
+		}
+
+	}
+
+	// it can't
+	clientsRefused.add(1)
+	host := stripHostPort(addr.String())
+	access.lock.Lock()
+	warned := access.warned[host]
+	access.warned[host] = true
+	access.lock.Unlock()
+	if !warned {
+
+		// let the user know
+		consoleSequence(fmt.Sprintf("-> refusing connections from %s%s%s (not in allowedClients)\n", code("red"), host, code("reset")))
+		writeLog(fmt.Sprintf("-> refusing connections from %s (not in allowedClients)\n", host))
+
+	}
+	return false
+
+}
+
+// a listener that closes connections from clients that aren't allowed
+type accessListener struct {
+	net.Listener
+	access *accessControl
+}
+
+// accept the next allowed connection
+func (listener *accessListener) Accept() (net.Conn, error) {
+
+	// until one is allowed
+	for {
+
+		// accept one
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+
+			// return the error
+			return nil, err
+
+		}
+
+		// check it
+		if listener.access.allows(conn.RemoteAddr()) {
+
+			// it is
+			return conn, nil
+
+		}
+		conn.Close()
+
+	}
+
+}
+
+// only accept allowed clients on a listener
+func (access *accessControl) listener(listener net.Listener) net.Listener {
+
+	// wrap it
+	return &accessListener{Listener: listener, access: access}
+
+}
+
+// check if a client can make another request
+func (access *accessControl) take(addr string) bool {
+
+	// there might not be a limit
+	if access.rate == 0 {
+
+		// there isn't
+		return true
+
+	}
+
+	// get the client's bucket
+	now := time.Now()
+	host := stripHostPort(addr)
+	access.lock.Lock()
+	defer access.lock.Unlock()
+	bucket, ok := access.buckets[host]
+	if !ok {
+
+		// forget clients that went quiet, now and then
+		if len(access.buckets) > 1024 {
+
+			// forget them
+			for other, old := range access.buckets {
+
+				// check it
+				if now.Sub(old.last) > rateLimitForget {
+
+					// forget it
+					delete(access.buckets, other)
+
+				}
+
+			}
+
+		}
+
+		// make it full
+		bucket = &rateBucket{tokens: access.burst, last: now}
+		access.buckets[host] = bucket
+
+	}
+
+	// refill it for the time since the last request
+	bucket.tokens = math.Min(access.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*access.rate)
+	bucket.last = now
+
+	// take one if there is one
+	if bucket.tokens < 1 {
+
+		// there isn't
+		return false
+
+	}
+	bucket.tokens--
+	return true
+
+}
+
+// refuse requests from clients that go over the rate limit
+func (access *accessControl) limit(handler http.Handler) http.Handler {
+
+	// check each request
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// check it
+		if !access.take(r.RemoteAddr) {
+
+			// refuse it
+			rateLimitedClients.add(1)
+			writeLog(fmt.Sprintf("-> refusing a request to %s from %s (over the rate limit)\n", r.URL.Host, stripHostPort(r.RemoteAddr)))
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(1/access.rate))))
+			http.Error(w, "slow down, maryo is limiting how many requests each console can make\n", http.StatusTooManyRequests)
+			return
+
+		}
+
+		// send it on
+		handler.ServeHTTP(w, r)
+
+	})
+
+}
+
+// check the login in an authorization header
+func (access *accessControl) loggedIn(header string) bool {
+
+	// it has to be basic
+	if !strings.HasPrefix(strings.ToLower(header), "basic ") {
+
+		// it isn't
+		return false
+
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len("basic "):]))
+	if err != nil {
+
+		// it is wrong
+		return false
+
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+
+		// it is wrong
+		return false
+
+	}
+
+	// check them
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(access.user)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(access.password)) == 1
+	return userOK && passwordOK
+
+}
+
+// ask for a login on requests that use the proxy, if one is set.
+// requests for maryo itself, like the pac file, don't need one
+func (access *accessControl) authenticate(handler http.Handler) http.Handler {
+
+	// there might not be a login
+	if access.user == "" {
+
+		// there isn't
+		return handler
+
+	}
+
+	// check each request
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// only proxy requests need it
+		if ((r.Method == "CONNECT") || r.URL.IsAbs()) && !access.loggedIn(r.Header.Get("Proxy-Authorization")) {
+
+			// ask for it
+			proxyAuthFailures.add(1)
+			writeLog(fmt.Sprintf("-> asking %s to log in\n", stripHostPort(r.RemoteAddr)))
+			w.Header().Set("Proxy-Authenticate", `Basic realm="maryo"`)
+			http.Error(w, "maryo needs a login, set the proxy username and password on the console\n", http.StatusProxyAuthRequired)
+			return
+
+		}
+
+		// it doesn't go any further
+		r.Header.Del("Proxy-Authorization")
+
+		// send it on
+		handler.ServeHTTP(w, r)
+
+	})
+
+}
+
+// ask for the login on pages of maryo's own that show things about
+// the consoles, if one is set. browsers visit these directly, so it
+// is asked for like a website would
+func (access *accessControl) protect(handler http.Handler) http.Handler {
+
+	// there might not be a login
+	if access.user == "" {
+
+		// there isn't
+		return handler
+
+	}
+
+	// check each request
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// check it
+		if !access.loggedIn(r.Header.Get("Authorization")) {
+
+			// ask for it
+			proxyAuthFailures.add(1)
+			w.Header().Set("WWW-Authenticate", `Basic realm="maryo"`)
+			http.Error(w, "maryo needs a login to show this page\n", http.StatusUnauthorized)
+			return
+
+		}
+
+		// show it
+		handler.ServeHTTP(w, r)
+
+	})
+
+}
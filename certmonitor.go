@@ -0,0 +1,240 @@
+/*
+
+maryo/certmonitor.go
+
+watches the CA and the certificates signed with it, warns
+before they expire, and can renew the maryo CA while running
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"time"
+)
+
+// how often the certificates are checked if the config doesn't say
+const defaultCertCheckInterval = "1h"
+
+// metrics for certificate expiry
+var caRenewals = newCounter("maryo_ca_renewals_total", "times the maryo CA was renewed while running")
+
+// watches the certificates the proxy uses
+type certMonitor struct {
+	cache     *leafCache
+	caName    string
+	autoRenew bool
+	interval  time.Duration
+}
+
+// make the monitor from the settings in the config
+func certMonitorFromConfig(configData map[string]interface{}, cache *leafCache) *certMonitor {
+
+	// get the interval
+	interval, err := time.ParseDuration(getSetting(configData, "certCheckInterval", defaultCertCheckInterval))
+	if (err != nil) || (interval <= 0) {
+
+		// use the default
+		fmt.Printf("[err]: certCheckInterval must be a duration like 30m or 6h, using %s\n", defaultCertCheckInterval)
+		interval, _ = time.ParseDuration(defaultCertCheckInterval)
+
+	}
+
+	// make it
+	monitor := &certMonitor{
+
+		cache:     cache,
+		caName:    getSetting(configData, "proxyCA", "nintendo"),
+		autoRenew: getSetting(configData, "autoRenewCA", "false") == "true",
+		interval:  interval,
+	}
+
+	// show how long the CA has left in the metrics
+	newGaugeFunc("maryo_ca_expiry_seconds", "seconds until the proxy CA expires", func() float64 {
+
+		// get it
+		return time.Until(cache.currentCA().Leaf.NotAfter).Seconds()
+
+	})
+	newGaugeFunc("maryo_leaf_cache_expiring", "leaf certificates in memory that expire soon", func() float64 {
+
+		// count them
+		return float64(cache.expiring(certExpiryWarning))
+
+	})
+
+	// return it
+	return monitor
+
+}
+
+// check the certificates every interval, forever
+func (monitor *certMonitor) run() {
+
+	// check them now
+	monitor.check()
+
+	// then every interval
+	for range time.Tick(monitor.interval) {
+
+		// check them
+		monitor.check()
+
+	}
+
+}
+
+// check the certificates, renewing the CA if it should be
+func (monitor *certMonitor) check() {
+
+	// check the CA
+	ca := monitor.cache.currentCA()
+	left := time.Until(ca.Leaf.NotAfter)
+	if left < certExpiryWarning {
+
+		// warn about it
+		monitor.warn(fmt.Sprintf("the %s CA (%s) expires in %d day(s), on %s", monitor.caName, ca.Leaf.Subject.CommonName, int(left.Hours()/24), ca.Leaf.NotAfter.Format(time.RFC1123)))
+
+		// renew it if we can
+		if monitor.autoRenew && (monitor.caName == "maryo") {
+
+			// renew it
+			monitor.renew(ca)
+
+		} else if monitor.caName == "maryo" {
+
+			// tell them how
+			monitor.warn("run maryo cert generate, or set \"autoRenewCA\": \"true\" to renew it automatically")
+
+		}
+
+	}
+
+	// check the leaves
+	if count := monitor.cache.expiring(certExpiryWarning); count != 0 {
+
+		// warn about them
+		monitor.warn(fmt.Sprintf("%d cached certificate(s) expire within %d days", count, int(certExpiryWarning.Hours()/24)))
+
+	}
+
+}
+
+// show a warning about a certificate
+func (monitor *certMonitor) warn(message string) {
+
+	// show it
+	consoleSequence(fmt.Sprintf("-> %s%s%s\n", code("yellow"), message, code("reset")))
+	writeLog(fmt.Sprintf("-> %s\n", message))
+
+}
+
+// make a new maryo CA like the old one, and switch to it
+func (monitor *certMonitor) renew(old *tls.Certificate) {
+
+	// generating panics on errors, which shouldn't stop the proxy
+	defer func() {
+
+		// catch it
+		if err := recover(); err != nil {
+
+			// show an error message
+			fmt.Printf("[err]: error while renewing the maryo CA: %v\n", err)
+
+		}
+
+	}()
+
+	// keep everything but the dates
+	opts := defaultCertOptions
+	opts.commonName = old.Leaf.Subject.CommonName
+	if len(old.Leaf.Subject.Organization) != 0 {
+
+		// keep the organization
+		opts.organization = old.Leaf.Subject.Organization[0]
+
+	}
+	opts.sans = old.Leaf.DNSNames
+	for _, ip := range old.Leaf.IPAddresses {
+
+		// add it
+		opts.sans = append(opts.sans, ip.String())
+
+	}
+	if length := old.Leaf.NotAfter.Sub(old.Leaf.NotBefore); length > 2*certExpiryWarning {
+
+		// keep the length, unless it is so short it would be
+		// renewed again right away
+		opts.days = int(length.Hours() / 24)
+
+	}
+	if key, ok := old.PrivateKey.(*rsa.PrivateKey); ok {
+
+		// keep the key size
+		opts.rsaBits = key.N.BitLen()
+
+	}
+	if key, ok := old.PrivateKey.(*ecdsa.PrivateKey); ok {
+
+		// keep the key type
+		opts.keyType = "ecdsa"
+		for name, curve := range ecdsaCurves {
+
+			// find the curve
+			if curve == key.Curve {
+
+				// use it
+				opts.curve = name
+
+			}
+
+		}
+
+	}
+
+	// generate it next to the old one, so the old one is still there
+	// if it fails
+	certFile, keyFile := "maryo-data/cert.pem.new", "maryo-data/cert.key.new"
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+	generateCertsTo(opts, certFile, keyFile)
+
+	// load it to make sure it works
+	ca, err := parseCA(tls.LoadX509KeyPair(certFile, keyFile))
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: the renewed maryo CA couldn't be loaded, keeping the old one: %s\n", err.Error())
+		return
+
+	}
+
+	// then put it in place
+	for _, file := range [][2]string{{certFile, "maryo-data/cert.pem"}, {keyFile, "maryo-data/cert.key"}} {
+
+		// move it
+		if err := os.Rename(file[0], file[1]); err != nil {
+
+			// show an error message
+			fmt.Printf("[err]: error while putting the renewed maryo CA in place: %s\n", err.Error())
+			return
+
+		}
+
+	}
+
+	// switch to it
+	monitor.cache.swapCA(&ca)
+	caRenewals.add(1)
+	monitor.warn(fmt.Sprintf("renewed the maryo CA, it is valid until %s. run maryo patch again so the console trusts it", ca.Leaf.NotAfter.Format(time.RFC1123)))
+
+}
@@ -0,0 +1,975 @@
+/*
+
+maryo/certs.go
+
+utilities for the certificates maryo uses to intercept connections,
+and the cert subcommand for managing them
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+	// externals
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// parse the cert in a keypair, so it can be used to sign
+func parseCA(ca tls.Certificate, err error) (tls.Certificate, error) {
+
+	// handle errors
+	if err != nil {
+
+		// return the error
+		return tls.Certificate{}, err
+
+	}
+
+	// parse the certificate so it can be used to sign
+	if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+
+		// return the error
+		return tls.Certificate{}, err
+
+	}
+
+	// return the CA
+	return ca, nil
+
+}
+
+// load the nintendo CA
+func loadNintendoCA() (tls.Certificate, error) {
+
+	// get the keypair from cert and key data
+	return parseCA(tls.X509KeyPair(nintyCert, nintyKey))
+
+}
+
+// load the CA in maryo-data
+func loadMaryoCA() (tls.Certificate, error) {
+
+	// get the keypair from the files
+	return parseCA(tls.LoadX509KeyPair("maryo-data/cert.pem", "maryo-data/cert.key"))
+
+}
+
+// load the CA the proxy signs its certificates with, which is
+// picked with proxyCA in the config
+func loadProxyCA(configData map[string]interface{}) (tls.Certificate, error) {
+
+	// check which one to use
+	switch name := getSetting(configData, "proxyCA", "nintendo"); name {
+
+	case "nintendo":
+
+		// the built in one
+		return loadNintendoCA()
+
+	case "maryo":
+
+		// the one in maryo-data
+		return loadMaryoCA()
+
+	default:
+
+		// it isn't one we know
+		return tls.Certificate{}, fmt.Errorf("%s is not a proxy CA (use nintendo or maryo)", name)
+
+	}
+
+}
+
+// sign a certificate for a host with a CA
+func signLeaf(ca *tls.Certificate, host string) (tls.Certificate, error) {
+
+	// serial number limit stuff
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+
+	// handle errors
+	if err != nil {
+
+		// return the error
+		return tls.Certificate{}, err
+
+	}
+
+	// populate certificate with data
+	template := &x509.Certificate{
+
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+
+			CommonName:   host,
+			Organization: []string{"maryo"},
+		},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              ca.Leaf.NotAfter,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	// the host can either be an ip or a name
+	if ip := net.ParseIP(host); ip != nil {
+
+		// add it as an ip
+		template.IPAddresses = []net.IP{ip}
+
+	} else {
+
+		// add it as a name
+		template.DNSNames = []string{host}
+
+	}
+
+	// generate private key
+	privatekey, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	// handle errors
+	if err != nil {
+
+		// return the error
+		return tls.Certificate{}, err
+
+	}
+
+	// sign it with the CA
+	cert, err := x509.CreateCertificate(rand.Reader, template, ca.Leaf, &privatekey.PublicKey, ca.PrivateKey)
+
+	// handle errors
+	if err != nil {
+
+		// return the error
+		return tls.Certificate{}, err
+
+	}
+
+	// parse it back
+	leaf, err := x509.ParseCertificate(cert)
+
+	// handle errors
+	if err != nil {
+
+		// return the error
+		return tls.Certificate{}, err
+
+	}
+
+	// return the certificate with the CA after it
+	return tls.Certificate{
+
+		Certificate: [][]byte{cert, ca.Certificate[0]},
+		PrivateKey:  privatekey,
+		Leaf:        leaf,
+	}, nil
+
+}
+
+// options for generating a cert and key pair
+type certOptions struct {
+	keyType      string
+	rsaBits      int
+	curve        string
+	days         int
+	commonName   string
+	organization string
+	sans         []string
+}
+
+// the options used when nothing else is asked for
+var defaultCertOptions = certOptions{
+
+	keyType:      "rsa",
+	rsaBits:      2048,
+	curve:        "p256",
+	days:         365,
+	commonName:   "maryo-cert",
+	organization: "pretendo",
+}
+
+// curves that can be used for ecdsa keys
+var ecdsaCurves = map[string]elliptic.Curve{"p256": elliptic.P256(), "p384": elliptic.P384(), "p521": elliptic.P521()}
+
+// generate a private key with the given options
+func generateKey(opts certOptions) (crypto.Signer, error) {
+
+	// check the key type
+	switch opts.keyType {
+
+	case "rsa":
+
+		// generate an rsa key
+		return rsa.GenerateKey(rand.Reader, opts.rsaBits)
+
+	case "ecdsa":
+
+		// get the curve
+		curve, ok := ecdsaCurves[opts.curve]
+		if !ok {
+
+			// it isn't one we know
+			return nil, fmt.Errorf("%s is not a curve (use p256, p384, or p521)", opts.curve)
+
+		}
+
+		// generate an ecdsa key
+		return ecdsa.GenerateKey(curve, rand.Reader)
+
+	}
+
+	// it isn't a key type we know
+	return nil, fmt.Errorf("%s is not a key type (use rsa or ecdsa)", opts.keyType)
+
+}
+
+// add subject alternative names to a certificate template
+func addSANs(template *x509.Certificate, sans []string) {
+
+	// add each of them
+	for _, san := range sans {
+
+		// the name can either be an ip or a name
+		if ip := net.ParseIP(san); ip != nil {
+
+			// add it as an ip
+			template.IPAddresses = append(template.IPAddresses, ip)
+
+		} else {
+
+			// add it as a name
+			template.DNSNames = append(template.DNSNames, san)
+
+		}
+
+	}
+
+}
+
+// encode a private key as a pem block
+func marshalKeyPEM(key crypto.PrivateKey) (*pem.Block, error) {
+
+	// check the key type
+	switch key := key.(type) {
+
+	case *rsa.PrivateKey:
+
+		// rsa keys are pkcs#1
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}, nil
+
+	case *ecdsa.PrivateKey:
+
+		// ecdsa keys are sec 1
+		data, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+
+			// return the error
+			return nil, err
+
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: data}, nil
+
+	}
+
+	// anything else is pkcs#8
+	data, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+
+		// return the error
+		return nil, err
+
+	}
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: data}, nil
+
+}
+
+// parse a der private key in any of the formats it could be in
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+
+	// try pkcs#1
+	if key, err := x509.ParsePKCS1PrivateKey(data); err == nil {
+
+		// it was
+		return key, nil
+
+	}
+
+	// then sec 1
+	if key, err := x509.ParseECPrivateKey(data); err == nil {
+
+		// it was
+		return key, nil
+
+	}
+
+	// then pkcs#8
+	key, err := x509.ParsePKCS8PrivateKey(data)
+	if err != nil {
+
+		// it isn't a key
+		return nil, errors.New("the key is not a pkcs#1, sec 1, or pkcs#8 private key")
+
+	}
+
+	// make sure it can sign
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+
+		// it can't
+		return nil, errors.New("the key can't be used for signing")
+
+	}
+
+	// return it
+	return signer, nil
+
+}
+
+// read a cert that is either pem or der
+func readCertFile(file string) (*x509.Certificate, error) {
+
+	// read the file
+	data := readFileByte(file)
+
+	// get the der out of it if it is pem
+	if block, _ := pem.Decode(data); block != nil {
+
+		// use the pem contents
+		data = block.Bytes
+
+	}
+
+	// parse it
+	return x509.ParseCertificate(data)
+
+}
+
+// read a private key that is either pem or der
+func readKeyFile(file string) (crypto.Signer, error) {
+
+	// read the file
+	data := readFileByte(file)
+
+	// get the der out of it if it is pem
+	if block, _ := pem.Decode(data); block != nil {
+
+		// use the pem contents
+		data = block.Bytes
+
+	}
+
+	// parse it
+	return parsePrivateKey(data)
+
+}
+
+// check that a private key belongs to a cert
+func keyMatchesCert(key crypto.Signer, cert *x509.Certificate) bool {
+
+	// public keys of all of the standard types can be compared
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+
+	// compare them
+	return ok && pub.Equal(cert.PublicKey)
+
+}
+
+// get the fingerprint of a cert
+func fingerprint(cert *x509.Certificate, sha1Hash bool) string {
+
+	// hash it
+	var sum []byte
+	if sha1Hash {
+
+		// with sha-1
+		hash := sha1.Sum(cert.Raw)
+		sum = hash[:]
+
+	} else {
+
+		// with sha-256
+		hash := sha256.Sum256(cert.Raw)
+		sum = hash[:]
+
+	}
+
+	// format it like openssl does
+	parts := []string{}
+	for _, b := range sum {
+
+		// add the byte
+		parts = append(parts, fmt.Sprintf("%02X", b))
+
+	}
+
+	// join them
+	return strings.Join(parts, ":")
+
+}
+
+// describe the key in a cert
+func describeKey(cert *x509.Certificate) string {
+
+	// check the key type
+	switch pub := cert.PublicKey.(type) {
+
+	case *rsa.PublicKey:
+
+		// rsa, with the size
+		return fmt.Sprintf("rsa %d bits", pub.N.BitLen())
+
+	case *ecdsa.PublicKey:
+
+		// ecdsa, with the curve
+		return fmt.Sprintf("ecdsa %s", pub.Curve.Params().Name)
+
+	}
+
+	// anything else
+	return cert.PublicKeyAlgorithm.String()
+
+}
+
+// flag value that collects repeated strings
+type stringList []string
+
+// show the list as a string
+func (l *stringList) String() string {
+
+	// join them
+	return strings.Join(*l, ",")
+
+}
+
+// add a string to the list
+func (l *stringList) Set(value string) error {
+
+	// add it
+	*l = append(*l, value)
+
+	// no errors
+	return nil
+
+}
+
+// cert subcommand
+func certCommand(args []string) {
+
+	// make sure there is an action
+	if len(args) == 0 {
+
+		// show the usage
+		fmt.Printf("usage: maryo cert show [--file <path>]\n")
+		fmt.Printf("       maryo cert generate [--key-type rsa|ecdsa] [--rsa-bits <n>] [--curve p256|p384|p521]\n")
+		fmt.Printf("                           [--days <n>] [--cn <name>] [--org <name>] [--san <name>]...\n")
+		fmt.Printf("       maryo cert import (--cert <path> --key <path> | --p12 <path> [--password <pass>])\n")
+		fmt.Printf("       maryo cert export --format pem|der|p12 [--out <path>] [--key] [--password <pass>]\n")
+		fmt.Printf("       maryo cert verify\n")
+		os.Exit(1)
+
+	}
+
+	// do the action
+	switch args[0] {
+
+	case "show":
+
+		// show the cert
+		showCert(args[1:])
+
+	case "generate":
+
+		// generate a new pair
+		generateCertCommand(args[1:])
+
+	case "import":
+
+		// import a pair
+		importCert(args[1:])
+
+	case "export":
+
+		// export the pair
+		exportCert(args[1:])
+
+	case "verify":
+
+		// verify the pair
+		verifyCert(args[1:])
+
+	default:
+
+		// show an error message
+		fmt.Printf("[err]: %s is not a cert action...\n", args[0])
+		fmt.Printf("       please use show, generate, import, export, or verify\n")
+		os.Exit(1)
+
+	}
+
+}
+
+// show what is in a cert
+func showCert(args []string) {
+
+	// flags for showing
+	flags := flag.NewFlagSet("cert show", flag.ExitOnError)
+	file := flags.String("file", "maryo-data/cert.pem", "path of the cert to show")
+	flags.Parse(args)
+
+	// make sure it exists
+	if !doesFileExist(*file) {
+
+		// show an error message
+		fmt.Printf("[err]: there is no cert at %s...\n", *file)
+		os.Exit(1)
+
+	}
+
+	// read it
+	cert, err := readCertFile(*file)
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: %s couldn't be read as a cert...\n", *file)
+		fmt.Printf("       %s\n", err.Error())
+		os.Exit(1)
+
+	}
+
+	// show it
+	fmt.Printf("-- %s\n", *file)
+	fmt.Printf(" subject:     %s\n", cert.Subject.String())
+	fmt.Printf(" issuer:      %s\n", cert.Issuer.String())
+	fmt.Printf(" serial:      %s\n", cert.SerialNumber.Text(16))
+	fmt.Printf(" valid from:  %s\n", cert.NotBefore.Format(time.RFC1123))
+	fmt.Printf(" valid until: %s\n", cert.NotAfter.Format(time.RFC1123))
+	fmt.Printf(" key:         %s\n", describeKey(cert))
+	fmt.Printf(" ca:          %t\n", cert.IsCA)
+
+	// show the alternative names
+	sans := []string{}
+	sans = append(sans, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+
+		// add the ip
+		sans = append(sans, ip.String())
+
+	}
+	if len(sans) != 0 {
+
+		// show them
+		fmt.Printf(" names:       %s\n", strings.Join(sans, ", "))
+
+	}
+
+	// show the fingerprints
+	fmt.Printf(" sha-256:     %s\n", fingerprint(cert, false))
+	fmt.Printf(" sha-1:       %s\n", fingerprint(cert, true))
+	fmt.Printf(" spki pin:    sha256/%s\n", spkiPin(cert))
+
+}
+
+// generate a new pair with options
+func generateCertCommand(args []string) {
+
+	// flags for generating
+	opts := defaultCertOptions
+	sans := stringList{}
+	flags := flag.NewFlagSet("cert generate", flag.ExitOnError)
+	flags.StringVar(&opts.keyType, "key-type", opts.keyType, "type of key to generate (rsa|ecdsa)")
+	flags.IntVar(&opts.rsaBits, "rsa-bits", opts.rsaBits, "size of the rsa key")
+	flags.StringVar(&opts.curve, "curve", opts.curve, "curve of the ecdsa key (p256|p384|p521)")
+	flags.IntVar(&opts.days, "days", opts.days, "how many days the cert is valid for")
+	flags.StringVar(&opts.commonName, "cn", opts.commonName, "common name of the cert")
+	flags.StringVar(&opts.organization, "org", opts.organization, "organization of the cert")
+	flags.Var(&sans, "san", "a dns name or ip to add to the cert (can be repeated)")
+	flags.Parse(args)
+	opts.sans = sans
+
+	// check the options before deleting anything
+	if _, ok := map[string]bool{"rsa": true, "ecdsa": true}[opts.keyType]; !ok {
+
+		// show an error message
+		fmt.Printf("[err]: %s is not a key type, please use rsa or ecdsa...\n", opts.keyType)
+		os.Exit(1)
+
+	}
+	if _, ok := ecdsaCurves[opts.curve]; !ok && (opts.keyType == "ecdsa") {
+
+		// show an error message
+		fmt.Printf("[err]: %s is not a curve, please use p256, p384, or p521...\n", opts.curve)
+		os.Exit(1)
+
+	}
+	if (opts.keyType == "rsa") && (opts.rsaBits < 1024) {
+
+		// show an error message
+		fmt.Printf("[err]: rsa keys have to be at least 1024 bits...\n")
+		os.Exit(1)
+
+	}
+	if opts.days < 1 {
+
+		// show an error message
+		fmt.Printf("[err]: the cert has to be valid for at least a day...\n")
+		os.Exit(1)
+
+	}
+
+	// generate it
+	generateCertsWith(opts)
+
+}
+
+// import a pair from other files
+func importCert(args []string) {
+
+	// flags for importing
+	flags := flag.NewFlagSet("cert import", flag.ExitOnError)
+	certFile := flags.String("cert", "", "path of the cert to import (pem or der)")
+	keyFile := flags.String("key", "", "path of the key to import (pem or der)")
+	p12File := flags.String("p12", "", "path of a pkcs#12 file to import the cert and key from")
+	password := flags.String("password", "", "password of the pkcs#12 file")
+	flags.Parse(args)
+
+	// the pair to import
+	var cert *x509.Certificate
+	var key crypto.Signer
+	var err error
+
+	// read it from wherever it is
+	if *p12File != "" {
+
+		// make sure it exists
+		if !doesFileExist(*p12File) {
+
+			// show an error message
+			fmt.Printf("[err]: there is no file at %s...\n", *p12File)
+			os.Exit(1)
+
+		}
+
+		// decode it
+		var p12Key interface{}
+		p12Key, cert, _, err = pkcs12.DecodeChain(readFileByte(*p12File), *password)
+		if err == nil {
+
+			// make sure the key can sign
+			var ok bool
+			if key, ok = p12Key.(crypto.Signer); !ok {
+
+				// it can't
+				err = errors.New("the key can't be used for signing")
+
+			}
+
+		}
+
+	} else if (*certFile != "") && (*keyFile != "") {
+
+		// make sure they exist
+		if !doesFileExist(*certFile) || !doesFileExist(*keyFile) {
+
+			// show an error message
+			fmt.Printf("[err]: %s or %s does not exist...\n", *certFile, *keyFile)
+			os.Exit(1)
+
+		}
+
+		// read them
+		cert, err = readCertFile(*certFile)
+		if err == nil {
+
+			// then the key
+			key, err = readKeyFile(*keyFile)
+
+		}
+
+	} else {
+
+		// show an error message
+		fmt.Printf("[err]: please pass --cert and --key, or --p12...\n")
+		os.Exit(1)
+
+	}
+
+	// handle errors
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: the cert and key couldn't be read...\n")
+		fmt.Printf("       %s\n", err.Error())
+		os.Exit(1)
+
+	}
+
+	// make sure they go together
+	if !keyMatchesCert(key, cert) {
+
+		// they don't
+		fmt.Printf("[err]: the key does not belong to the cert...\n")
+		os.Exit(1)
+
+	}
+
+	// encode the key
+	keyBlock, err := marshalKeyPEM(key)
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: the key couldn't be encoded...\n")
+		fmt.Printf("       %s\n", err.Error())
+		os.Exit(1)
+
+	}
+
+	// make sure the maryo folder exists
+	if doesDirExist("maryo-data") == false {
+
+		// make it if it doesn't
+		makeDirectory("maryo-data")
+
+	}
+
+	// write them
+	writeByteToFile("maryo-data/cert.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	writePrivateFile("maryo-data/cert.key", pem.EncodeToMemory(keyBlock))
+
+	// let the user know
+	fmt.Printf("imported %s into maryo-data...\n", cert.Subject.String())
+	fmt.Printf("sha-256: %s\n", fingerprint(cert, false))
+
+}
+
+// make sure the pair in maryo-data is there, exiting if it isn't
+func requireMaryoPair() {
+
+	// check both halves
+	if !doesFileExist("maryo-data/cert.pem") || !doesFileExist("maryo-data/cert.key") {
+
+		// show an error message
+		fmt.Printf("[err]: maryo-data/cert.pem or maryo-data/cert.key is missing, run maryo cert generate first\n")
+		os.Exit(1)
+
+	}
+
+}
+
+// export the pair in another format
+func exportCert(args []string) {
+
+	// flags for exporting
+	flags := flag.NewFlagSet("cert export", flag.ExitOnError)
+	format := flags.String("format", "pem", "format to export in (pem|der|p12)")
+	out := flags.String("out", "", "path to write to (pem is shown in the terminal if this isn't given)")
+	exportKey := flags.Bool("key", false, "if set, the key is exported instead of the cert (pem and der only)")
+	password := flags.String("password", "", "password to protect the pkcs#12 file with")
+	flags.Parse(args)
+
+	// there has to be a pair
+	requireMaryoPair()
+
+	// read the pair
+	cert, err := readCertFile("maryo-data/cert.pem")
+	var key crypto.Signer
+	if err == nil {
+
+		// then the key
+		key, err = readKeyFile("maryo-data/cert.key")
+
+	}
+
+	// handle errors
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: the cert and key in maryo-data couldn't be read...\n")
+		fmt.Printf("       %s\n", err.Error())
+		os.Exit(1)
+
+	}
+
+	// the data to export
+	var data []byte
+
+	// encode it
+	switch *format {
+
+	case "pem":
+
+		// the cert or the key
+		if *exportKey {
+
+			// the key
+			var block *pem.Block
+			block, err = marshalKeyPEM(key)
+			if err == nil {
+
+				// encode it
+				data = pem.EncodeToMemory(block)
+
+			}
+
+		} else {
+
+			// the cert
+			data = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+
+		}
+
+	case "der":
+
+		// the cert or the key
+		if *exportKey {
+
+			// the key, as pkcs#8
+			data, err = x509.MarshalPKCS8PrivateKey(key)
+
+		} else {
+
+			// the cert
+			data = cert.Raw
+
+		}
+
+	case "p12":
+
+		// both of them
+		data, err = pkcs12.Modern.Encode(key, cert, nil, *password)
+
+	default:
+
+		// show an error message
+		fmt.Printf("[err]: %s is not a format, please use pem, der, or p12...\n", *format)
+		os.Exit(1)
+
+	}
+
+	// handle errors
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: error while encoding the %s...\n", *format)
+		fmt.Printf("       %s\n", err.Error())
+		os.Exit(1)
+
+	}
+
+	// show pem in the terminal if there is nowhere to write it
+	if *out == "" {
+
+		// binary formats need a file
+		if *format != "pem" {
+
+			// show an error message
+			fmt.Printf("[err]: please pass --out to export %s...\n", *format)
+			os.Exit(1)
+
+		}
+
+		// show it
+		fmt.Printf("%s", string(data))
+		return
+
+	}
+
+	// write it, keeping anything with the key in it private
+	if *exportKey || (*format == "p12") {
+
+		// only we can read it
+		writePrivateFile(*out, data)
+
+	} else {
+
+		// anyone can read the cert
+		writeByteToFile(*out, data)
+
+	}
+	fmt.Printf("exported to %s...\n", *out)
+
+}
+
+// verify the pair in maryo-data
+func verifyCert(args []string) {
+
+	// flags for verifying
+	flags := flag.NewFlagSet("cert verify", flag.ExitOnError)
+	flags.Parse(args)
+
+	// there has to be a pair
+	requireMaryoPair()
+
+	// use the doctor's checks
+	report := &doctorReport{}
+	doctorCerts(report)
+
+	// check the key matches, in more detail than loading it does
+	cert, err := readCertFile("maryo-data/cert.pem")
+	var key crypto.Signer
+	if err == nil {
+
+		// then the key
+		key, err = readKeyFile("maryo-data/cert.key")
+
+	}
+	if err == nil {
+
+		// compare them
+		if keyMatchesCert(key, cert) {
+
+			// they match
+			report.pass("key", fmt.Sprintf("%s, belongs to the cert", describeKey(cert)))
+
+		} else {
+
+			// they don't
+			report.fail("key", "does not belong to the cert")
+
+		}
+
+		// check that it can sign other certs
+		if !cert.IsCA || (cert.KeyUsage&x509.KeyUsageCertSign == 0) {
+
+			// it can't
+			report.warn("ca", "the cert can't be used to sign other certs")
+
+		}
+
+		// show the fingerprint
+		fmt.Printf("  sha-256: %s\n", fingerprint(cert, false))
+
+	}
+
+	// exit with the right status
+	if report.failed != 0 {
+
+		// something is wrong
+		os.Exit(1)
+
+	}
+
+}
@@ -0,0 +1,274 @@
+/*
+
+maryo/connect.go
+
+tells the user what to put into their console's
+network settings, in the terminal and on a web page
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"flag"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	// externals
+	"rsc.io/qr"
+)
+
+// steps for setting the proxy on a wii u
+var connectSteps = []string{
+	"open System Settings, then Internet",
+	"choose Connect to the Internet, then Connections",
+	"pick the connection you use, then Change Settings",
+	"go to Proxy Settings and choose Set",
+	"enter %s as the proxy server and %s as the port",
+	connectNoLoginStep,
+	"save the settings, and run a connection test",
+}
+
+// the authentication step, without and with a login
+const (
+	connectNoLoginStep = "choose Confirm, then Do Not Use Authentication"
+	connectLoginStep   = "choose Confirm, then Use Authentication, and enter %s as the username and the proxyPassword from maryo's config as the password"
+)
+
+// the page shown to anything that visits the proxy directly
+var connectPage = template.Must(template.New("connect").Parse(`<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>maryo</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; }
+code { font-size: 1.3em; background: #eee; padding: 0.1em 0.3em; }
+</style>
+</head>
+<body>
+<h1>maryo</h1>
+<p>this proxy is running. to use it, set these in your console's network settings:</p>
+<p>proxy server: <code>{{.IP}}</code><br>port: <code>{{.Port}}</code></p>
+<ol>
+{{range .Steps}}<li>{{.}}</li>
+{{end}}</ol>
+</body>
+</html>
+`))
+
+// get the steps with the address filled in. user is the login
+// the proxy asks for, if there is one
+func connectInfoSteps(ip string, user string) []string {
+
+	// list of steps
+	steps := []string{}
+
+	// fill in each of them
+	for _, step := range connectSteps {
+
+		// only the proxy step has anything to fill in
+		if strings.Contains(step, "%s") {
+
+			// fill it in
+			step = fmt.Sprintf(step, ip, proxyPort)
+
+		}
+
+		// the console has to log in if there is a login
+		if (step == connectNoLoginStep) && (user != "") {
+
+			// tell it to
+			step = fmt.Sprintf(connectLoginStep, user)
+
+		}
+
+		// add it
+		steps = append(steps, step)
+
+	}
+
+	// return the steps
+	return steps
+
+}
+
+// render a qr code with block characters, so it can be
+// shown in a terminal
+func renderQR(text string) (string, error) {
+
+	// encode the text
+	code, err := qr.Encode(text, qr.L)
+
+	// handle errors
+	if err != nil {
+
+		// return the error
+		return "", err
+
+	}
+
+	// the rendered code
+	var rendered strings.Builder
+
+	// each character covers two rows, and the quiet zone
+	// around the code is two pixels wide
+	for y := -2; y < code.Size+2; y += 2 {
+
+		// pad it a little
+		rendered.WriteString("  ")
+
+		// draw each column
+		for x := -2; x < code.Size+2; x++ {
+
+			// get the pixels, drawing white ones so the code
+			// shows up on dark terminals
+			top := !code.Black(x, y)
+			bottom := !code.Black(x, y+1) && (y+1 < code.Size+2)
+
+			// pick the character
+			if top && bottom {
+
+				// both
+				rendered.WriteString("█")
+
+			} else if top {
+
+				// top only
+				rendered.WriteString("▀")
+
+			} else if bottom {
+
+				// bottom only
+				rendered.WriteString("▄")
+
+			} else {
+
+				// neither
+				rendered.WriteString(" ")
+
+			}
+
+		}
+
+		// next row
+		rendered.WriteString("\n")
+
+	}
+
+	// return it
+	return rendered.String(), nil
+
+}
+
+// show the connection info in the terminal
+func printConnectInfo(ip string, user string) {
+
+	// the address of the info page
+	page := fmt.Sprintf("http://%s:%s/", ip, proxyPort)
+
+	// show the header
+	fmt.Printf("-- connecting your console\n")
+	consoleSequence(fmt.Sprintf(" proxy server: %s%s%s\n", code("green"), ip, code("reset")))
+	consoleSequence(fmt.Sprintf(" port:         %s%s%s\n", code("green"), proxyPort, code("reset")))
+	if user != "" {
+
+		// and the login
+		consoleSequence(fmt.Sprintf(" username:     %s%s%s\n", code("green"), user, code("reset")))
+
+	}
+
+	// show the steps
+	for x, step := range connectInfoSteps(ip, user) {
+
+		// show it
+		fmt.Printf(" %d. %s\n", x+1, step)
+
+	}
+
+	// show the qr code
+	rendered, err := renderQR(page)
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: error while making the qr code\n")
+		fmt.Printf("%s\n", err.Error())
+		return
+
+	}
+	fmt.Printf("\n scan this to see these steps on your phone (%s):\n\n", page)
+	fmt.Printf("%s\n", rendered)
+
+}
+
+// make the handler for requests made to the proxy itself. pages that
+// show what the consoles are doing need the login, if there is one
+func newInfoMux(ip string, access *accessControl) *http.ServeMux {
+
+	// make the mux
+	mux := http.NewServeMux()
+
+	// the connection info page
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+
+		// only the root is a page
+		if r.URL.Path != "/" {
+
+			// not found
+			http.NotFound(w, r)
+			return
+
+		}
+
+		// show the page
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := connectPage.Execute(w, map[string]interface{}{"IP": ip, "Port": proxyPort, "Steps": connectInfoSteps(ip, access.user)})
+
+		// handle errors
+		if err != nil {
+
+			// show an error message
+			fmt.Printf("[err]: error while showing the info page\n")
+			fmt.Printf("%s\n", err.Error())
+
+		}
+
+	})
+
+	// the proxy's metrics
+	mux.Handle("/metrics", access.protect(http.HandlerFunc(metricsHandler)))
+
+	// return it
+	return mux
+
+}
+
+// connect-info subcommand
+func connectInfoCommand(args []string) {
+
+	// flags for connect-info
+	flags := flag.NewFlagSet("connect-info", flag.ExitOnError)
+	configPath := flags.String("config", "maryo-data/config.json", "path of the config to get the interface from")
+	flags.Parse(args)
+
+	// the preferred interface and login, if there is a config
+	preferred, user := "", ""
+	if doesFileExist(*configPath) && checkJSONValidity(*configPath) {
+
+		// get them from the config
+		configData := readJSONFile(*configPath)
+		preferred = getSetting(configData, "interface", "")
+		user = getSetting(configData, "proxyUser", "")
+
+	}
+
+	// show the info
+	printConnectInfo(getIP(preferred), user)
+
+}
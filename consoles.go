@@ -0,0 +1,471 @@
+/*
+
+maryo/consoles.go
+
+tells the consoles using the proxy apart, by their address and
+the headers nintendo's software sends, so each can be given a
+name and its own endpoints
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the headers consoles identify themselves with
+const (
+	serialHeader   = "X-Nintendo-Serial-Number"
+	deviceIDHeader = "X-Nintendo-Device-ID"
+	platformHeader = "X-Nintendo-Platform-ID"
+)
+
+// the names of the platform ids
+var platformNames = map[string]string{
+	"0": "3ds",
+	"1": "wii u",
+}
+
+// a console from the consoles section of the config
+type consoleConfig struct {
+	name      string
+	networks  []*net.IPNet
+	serial    string
+	deviceID  string
+	endpoints map[string]interface{}
+}
+
+// a console that has used the proxy
+type seenConsole struct {
+	ip       string
+	serial   string
+	deviceID string
+	platform string
+	config   *consoleConfig
+	requests int64
+	lastSeen time.Time
+}
+
+// get the name to show for a console
+func (console *seenConsole) label() string {
+
+	// use the one from the config
+	if console.config != nil {
+
+		// use it
+		return console.config.name
+
+	}
+
+	// or the address
+	return console.ip
+
+}
+
+// the consoles from the config, and the ones that have been seen
+type consoleRegistry struct {
+	configured []*consoleConfig
+	lock       sync.Mutex
+	seen       map[string]*seenConsole
+}
+
+// read the consoles section of the config
+func consolesFromConfig(configData map[string]interface{}) (*consoleRegistry, error) {
+
+	// make it
+	registry := &consoleRegistry{seen: make(map[string]*seenConsole)}
+
+	// there might not be any
+	section, _ := configData["consoles"].(map[string]interface{})
+	names := []string{}
+	for name := range section {
+
+		// add it
+		names = append(names, name)
+
+	}
+	sort.Strings(names)
+
+	// read each of them
+	for _, name := range names {
+
+		// it has to be an object
+		settings, ok := section[name].(map[string]interface{})
+		if !ok {
+
+			// it isn't
+			return nil, fmt.Errorf("the console %s in consoles isn't an object", name)
+
+		}
+
+		// read how it is recognized
+		console := &consoleConfig{name: name, endpoints: make(map[string]interface{})}
+		console.serial, _ = settings["serial"].(string)
+		console.deviceID, _ = settings["deviceID"].(string)
+		ips := stringsOf(settings["ips"])
+		if ip, ok := settings["ip"].(string); ok {
+
+			// one address can be given on its own
+			ips = append(ips, ip)
+
+		}
+		networks, err := parseNetworks(ips)
+		if err != nil {
+
+			// it is wrong
+			return nil, fmt.Errorf("the ip of the console %s is wrong: %s", name, err.Error())
+
+		}
+		console.networks = networks
+		if (console.serial == "") && (console.deviceID == "") && (len(console.networks) == 0) {
+
+			// there's no way to tell it is this one
+			return nil, fmt.Errorf("the console %s needs an ip, serial, or deviceID", name)
+
+		}
+
+		// read its endpoints
+		endpoints, _ := settings["endpoints"].(map[string]interface{})
+		for from, to := range endpoints {
+
+			// they have to be addresses
+			if _, ok := to.(string); !ok {
+
+				// it isn't
+				return nil, fmt.Errorf("the endpoint %s of the console %s isn't a string", from, name)
+
+			}
+			console.endpoints[strings.ToLower(from)] = to
+
+		}
+
+		// add it
+		registry.configured = append(registry.configured, console)
+
+	}
+
+	// keep count of them
+	newGaugeFunc("maryo_consoles_seen", "consoles that have used the proxy", func() float64 {
+
+		// count them
+		registry.lock.Lock()
+		defer registry.lock.Unlock()
+		return float64(len(registry.seen))
+
+	})
+
+	// return it
+	return registry, nil
+
+}
+
+// get every host that is redirected, for any console
+func routedHosts(configData map[string]interface{}) []string {
+
+	// the endpoints everything uses
+	hosts := []string{}
+	known := make(map[string]bool)
+	endpoints, _ := configData["endpoints"].(map[string]interface{})
+	for host := range endpoints {
+
+		// add it
+		hosts = append(hosts, host)
+		known[strings.ToLower(host)] = true
+
+	}
+
+	// and the ones only some consoles use
+	section, _ := configData["consoles"].(map[string]interface{})
+	for _, value := range section {
+
+		// get its endpoints
+		settings, _ := value.(map[string]interface{})
+		endpoints, _ := settings["endpoints"].(map[string]interface{})
+		for host := range endpoints {
+
+			// add it if it is new
+			if !known[strings.ToLower(host)] {
+
+				// add it
+				hosts = append(hosts, host)
+				known[strings.ToLower(host)] = true
+
+			}
+
+		}
+
+	}
+
+	// return them
+	return hosts
+
+}
+
+// find the console in the config that matches one that was seen
+func (registry *consoleRegistry) match(console *seenConsole) *consoleConfig {
+
+	// the serial and device id are the surest
+	for _, configured := range registry.configured {
+
+		// check them
+		if ((configured.serial != "") && strings.EqualFold(configured.serial, console.serial)) || ((configured.deviceID != "") && (configured.deviceID == console.deviceID)) {
+
+			// it is this one
+			return configured
+
+		}
+
+	}
+
+	// then the address
+	ip := net.ParseIP(console.ip)
+	for _, configured := range registry.configured {
+
+		// check each network
+		for _, network := range configured.networks {
+
+			// check it
+			if (ip != nil) && network.Contains(ip) {
+
+				// it is this one
+				return configured
+
+			}
+
+		}
+
+	}
+
+	// it isn't in the config
+	return nil
+
+}
+
+// work out which console sent a request, giving the name to show
+// and the endpoints only it uses. the headers are remembered, so
+// requests without them are still known by the address they came from
+func (registry *consoleRegistry) identify(r *http.Request) (string, map[string]interface{}) {
+
+	// get the console at this address
+	ip := stripHostPort(r.RemoteAddr)
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	console, ok := registry.seen[ip]
+	if !ok {
+
+		// it is new
+		console = &seenConsole{ip: ip}
+		registry.seen[ip] = console
+
+	}
+
+	// keep what it says about itself
+	changed := !ok
+	for header, field := range map[string]*string{serialHeader: &console.serial, deviceIDHeader: &console.deviceID, platformHeader: &console.platform} {
+
+		// check it
+		if value := r.Header.Get(header); (value != "") && (value != *field) {
+
+			// keep it
+			*field = value
+			changed = true
+
+		}
+
+	}
+
+	// find it in the config
+	if changed {
+
+		// find it
+		console.config = registry.match(console)
+
+		// let the user know
+		consoleSequence(fmt.Sprintf("-> console %s%s%s is at %s%s\n", code("green"), console.label(), code("reset"), ip, console.details()))
+		writeLog(fmt.Sprintf("-> console %s is at %s%s\n", console.label(), ip, console.details()))
+
+	}
+
+	// count it
+	console.requests++
+	console.lastSeen = time.Now()
+
+	// return what the proxy needs
+	if console.config == nil {
+
+		// it only has the address
+		return console.label(), nil
+
+	}
+	return console.label(), console.config.endpoints
+
+}
+
+// describe what a console has said about itself
+func (console *seenConsole) details() string {
+
+	// list what is known
+	details := []string{}
+	if console.platform != "" {
+
+		// name the platform if we know it
+		platform, ok := platformNames[console.platform]
+		if !ok {
+
+			// we don't
+			platform = fmt.Sprintf("platform %s", console.platform)
+
+		}
+		details = append(details, platform)
+
+	}
+	if console.serial != "" {
+
+		// add it
+		details = append(details, fmt.Sprintf("serial %s", console.serial))
+
+	}
+	if console.deviceID != "" {
+
+		// add it
+		details = append(details, fmt.Sprintf("device id %s", console.deviceID))
+
+	}
+
+	// there might not be anything
+	if len(details) == 0 {
+
+		// there isn't
+		return ""
+
+	}
+	return fmt.Sprintf(" (%s)", strings.Join(details, ", "))
+
+}
+
+// get the endpoint a console uses for a host, if it has its own
+func (registry *consoleRegistry) endpointAt(ip string, host string) (string, bool) {
+
+	// get the console at this address
+	registry.lock.Lock()
+	console, ok := registry.seen[ip]
+	var configured *consoleConfig
+	if ok {
+
+		// use the one it was matched to
+		configured = console.config
+
+	}
+	registry.lock.Unlock()
+	if configured == nil {
+
+		// it hasn't been seen yet, so only the address can be used
+		configured = registry.match(&seenConsole{ip: ip})
+
+	}
+
+	// get its endpoint
+	if configured == nil {
+
+		// it has none
+		return "", false
+
+	}
+	return endpointFor(configured.endpoints, host)
+
+}
+
+// the page that lists the consoles
+var consolesPage = template.Must(template.New("consoles").Parse(`<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="5">
+<title>maryo consoles</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 2em auto; padding: 0 1em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.3em 0.6em; border-bottom: 1px solid #ddd; }
+</style>
+</head>
+<body>
+<h1>consoles</h1>
+{{if .}}<table>
+<tr><th>name</th><th>address</th><th>platform</th><th>serial</th><th>device id</th><th>own endpoints</th><th>requests</th><th>last seen</th></tr>
+{{range .}}<tr><td>{{.Name}}</td><td>{{.IP}}</td><td>{{.Platform}}</td><td>{{.Serial}}</td><td>{{.DeviceID}}</td><td>{{.Endpoints}}</td><td>{{.Requests}}</td><td>{{.LastSeen}}</td></tr>
+{{end}}</table>
+{{else}}<p>no consoles have used the proxy yet.</p>
+{{end}}</body>
+</html>
+`))
+
+// show the consoles that have used the proxy
+func (registry *consoleRegistry) serveConsoles(w http.ResponseWriter, r *http.Request) {
+
+	// list them, most recent first
+	registry.lock.Lock()
+	consoles := []*seenConsole{}
+	for _, console := range registry.seen {
+
+		// add it
+		consoles = append(consoles, console)
+
+	}
+	sort.Slice(consoles, func(x, y int) bool { return consoles[x].lastSeen.After(consoles[y].lastSeen) })
+	rows := []map[string]interface{}{}
+	for _, console := range consoles {
+
+		// describe it
+		platform, ok := platformNames[console.platform]
+		if !ok {
+
+			// show the id as is
+			platform = console.platform
+
+		}
+		endpoints := 0
+		if console.config != nil {
+
+			// count them
+			endpoints = len(console.config.endpoints)
+
+		}
+		rows = append(rows, map[string]interface{}{
+
+			"Name":      console.label(),
+			"IP":        console.ip,
+			"Platform":  platform,
+			"Serial":    console.serial,
+			"DeviceID":  console.deviceID,
+			"Endpoints": endpoints,
+			"Requests":  console.requests,
+			"LastSeen":  fmt.Sprintf("%s ago", time.Since(console.lastSeen).Round(time.Second)),
+		})
+
+	}
+	registry.lock.Unlock()
+
+	// show the page
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := consolesPage.Execute(w, rows); err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: error while showing the consoles page\n")
+		fmt.Printf("%s\n", err.Error())
+
+	}
+
+}
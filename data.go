@@ -9,24 +9,93 @@ if you want a copy, go to http://www.gnu.org/licenses/
 
 package main
 
+import (
+	// internals
+	"embed"
+	"time"
+)
+
 // struct for the isitworking endpoint
 type isitworkingStruct struct {
 	Server string `json:"server"`
 }
 
-// TODO: somewhere in here include a list containing a list of templates to add
+// struct for the setup answers file
+type setupAnswersStruct struct {
+	Config    string            `json:"config"`
+	Method    string            `json:"method"`
+	Template  string            `json:"template"`
+	Endpoints map[string]string `json:"endpoints"`
+	HTTPS     bool              `json:"https"`
+	Interface string            `json:"interface"`
+	Yes       bool              `json:"yes"`
+}
+
+// struct for a config template
+type templateStruct struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Endpoints   map[string]string      `json:"endpoints"`
+	Settings    map[string]interface{} `json:"settings"`
+}
 
-// pretendo stock config
-var pretendoConf = map[string]map[string]string{"config": map[string]string{"decryptOutgoing": "false"}, "endpoints": map[string]string{"account.nintendo.net": "account.pretendo.cc"}}
+// templates that come with maryo, from the templates folder
+// (more can be placed in maryo-data/templates)
+//
+//go:embed templates/*.json
+var builtinTemplates embed.FS
 
-// local stock config
-var localConf = map[string]map[string]string{"config": map[string]string{"decryptOutgoing": "true"}, "endpoints": map[string]string{"account.nintendo.net": "127.0.0.1:8080"}}
+// services the wii u uses, in the order they are tested
+var testServices = []string{"account", "discovery", "olv", "eshop", "ias", "ccs", "nus", "tagaya", "idbe", "conntest"}
 
 // test endpoints
-var testEndpoints = map[string]map[string]string{"official": map[string]string{"account": "account.pretendo.cc"}, "local": map[string]string{"account": "127.0.0.1:8080"}, "ninty": map[string]string{"account": "account.nintendo.net"}}
+var testEndpoints = map[string]map[string]string{
+	"official": map[string]string{
+		"account":   "account.pretendo.cc",
+		"discovery": "discovery.olv.pretendo.cc",
+		"olv":       "api.olv.pretendo.cc",
+		"eshop":     "ecs.wup.shop.pretendo.cc",
+		"ias":       "ias.wup.shop.pretendo.cc",
+		"ccs":       "ccs.wup.shop.pretendo.cc",
+		"nus":       "nus.wup.shop.pretendo.cc",
+		"tagaya":    "tagaya.wup.shop.pretendo.cc",
+		"idbe":      "idbe-wup.cdn.pretendo.cc",
+		"conntest":  "conntest.pretendo.cc",
+	},
+	"local": map[string]string{
+		"account":   "127.0.0.1:8080",
+		"discovery": "127.0.0.1:8081",
+		"olv":       "127.0.0.1:8082",
+		"eshop":     "127.0.0.1:8083",
+		"ias":       "127.0.0.1:8084",
+		"ccs":       "127.0.0.1:8085",
+		"nus":       "127.0.0.1:8086",
+		"tagaya":    "127.0.0.1:8087",
+		"idbe":      "127.0.0.1:8088",
+		"conntest":  "127.0.0.1:8089",
+	},
+	"ninty": map[string]string{
+		"account":   "account.nintendo.net",
+		"discovery": "discovery.olv.nintendo.net",
+		"olv":       "api.olv.nintendo.net",
+		"eshop":     "ecs.wup.shop.nintendo.net",
+		"ias":       "ias.wup.shop.nintendo.net",
+		"ccs":       "ccs.wup.shop.nintendo.net",
+		"nus":       "nus.wup.shop.nintendo.net",
+		"tagaya":    "tagaya.wup.shop.nintendo.net",
+		"idbe":      "idbe-wup.cdn.nintendo.net",
+		"conntest":  "conntest.nintendowifi.net",
+	},
+}
 
 // supposed return value for custom servers
-var resMap = map[string]string{"account": "account.nintendo.net"}
+var resMap = testEndpoints["ninty"]
+
+// how long to wait for a server while testing it
+const testTimeout = 5 * time.Second
+
+// port the proxy is hosted on
+const proxyPort = "9437"
 
 // icons used for displaying results
 var utilIcons = map[string]string{"success": "√", "failiure": "×", "uncertain": "-"}
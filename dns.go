@@ -0,0 +1,383 @@
+/*
+
+maryo/dns.go
+
+a dns server that points the hosts in the endpoints table at
+maryo, for consoles that are set up with a dns server instead
+of a proxy
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+	// externals
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// how long answers can be cached by the console, in seconds
+const dnsTTL = 60
+
+// how long to wait for the upstream dns server
+const dnsUpstreamTimeout = 5 * time.Second
+
+// set by the dns subcommand to start the proxy in dns mode
+var dnsMode = false
+
+// metrics for the dns server
+var (
+	dnsQueries   = newCounter("maryo_dns_queries_total", "dns queries received")
+	dnsAnswered  = newCounter("maryo_dns_answered_total", "dns queries answered for endpoint hosts")
+	dnsForwarded = newCounter("maryo_dns_forwarded_total", "dns queries forwarded to the upstream dns server")
+	dnsRefused   = newCounter("maryo_dns_refused_total", "dns queries refused")
+)
+
+// the dns server
+type dnsServer struct {
+	endpoints map[string]interface{}
+	hosts     []string
+	self      net.IP
+	answer    string
+	upstream  string
+	consoles  *consoleRegistry
+}
+
+// start the dns server, answering for the endpoints with ip
+func startDNS(configData map[string]interface{}, ip string, access *accessControl, consoles *consoleRegistry) {
+
+	// get the endpoints, and the hosts any console has one for
+	endpoints, _ := configData["endpoints"].(map[string]interface{})
+	hosts := routedHosts(configData)
+
+	// make the server
+	server := &dnsServer{
+
+		endpoints: endpoints,
+		hosts:     hosts,
+		self:      net.ParseIP(ip),
+		answer:    getSetting(configData, "dnsAnswer", "self"),
+		upstream:  getSetting(configData, "dnsUpstream", ""),
+		consoles:  consoles,
+	}
+	if (server.answer != "self") && (server.answer != "target") {
+
+		// it has to be one of them
+		fmt.Printf("[err]: dnsAnswer must be self or target, using self\n")
+		server.answer = "self"
+
+	}
+	if (server.upstream != "") && !strings.Contains(server.upstream, ":") {
+
+		// use the normal port
+		server.upstream = net.JoinHostPort(server.upstream, "53")
+
+	}
+
+	// listen
+	port := getSetting(configData, "dnsPort", "53")
+	conn, err := net.ListenPacket("udp", strings.Join([]string{":", port}, ""))
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: couldn't start the dns server on port %s: %s\n", port, err.Error())
+		fmt.Printf("       port 53 usually needs root (or administrator) to listen on\n")
+		return
+
+	}
+
+	// stop it with the proxy
+	currentSession.closeOnShutdown(func() { conn.Close() })
+
+	// let the user know
+	consoleSequence(fmt.Sprintf("-> hosting dns on %s:%s%s, set it as the console's primary dns\n", code("green"), port, code("reset")))
+	writeLog(fmt.Sprintf("-> hosting dns on port :%s\n", port))
+	if server.upstream == "" {
+
+		// everything else is refused
+		consoleSequence(fmt.Sprintf("-> %sno dnsUpstream is set, so other hosts won't resolve%s\n", code("yellow"), code("reset")))
+
+	}
+
+	// answer queries
+	go func() {
+
+		// forever
+		buf := make([]byte, 512)
+		for {
+
+			// read one
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+
+				// stop if it was closed
+				if errors.Is(err, net.ErrClosed) {
+
+					// it was
+					return
+
+				}
+
+				// show an error message
+				fmt.Printf("[err]: error while reading a dns query: %s\n", err.Error())
+				continue
+
+			}
+
+			// only for allowed clients
+			if !access.allows(addr) {
+
+				// ignore it
+				continue
+
+			}
+
+			// answer it
+			query := make([]byte, n)
+			copy(query, buf[:n])
+			go server.handle(conn, addr, query)
+
+		}
+
+	}()
+
+}
+
+// answer a query
+func (server *dnsServer) handle(conn net.PacketConn, addr net.Addr, query []byte) {
+
+	// count it
+	dnsQueries.add(1)
+
+	// read it
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+
+		// it isn't dns
+		return
+
+	}
+	question, err := parser.Question()
+	if err != nil {
+
+		// there's nothing to answer
+		return
+
+	}
+	name := strings.TrimSuffix(strings.ToLower(question.Name.String()), ".")
+
+	// answer for the endpoints
+	if hostMatchesAny(server.hosts, name) {
+
+		// answer it
+		dnsAnswered.add(1)
+		server.reply(conn, addr, header, question, dnsmessage.RCodeSuccess, server.addresses(addr, name))
+		return
+
+	}
+
+	// forward everything else
+	if server.upstream != "" {
+
+		// forward it
+		reply, err := server.forward(query)
+		if err != nil {
+
+			// show an error message
+			fmt.Printf("[err]: error while forwarding the dns query for %s: %s\n", name, err.Error())
+			server.reply(conn, addr, header, question, dnsmessage.RCodeServerFailure, nil)
+			return
+
+		}
+		dnsForwarded.add(1)
+		conn.WriteTo(reply, addr)
+		return
+
+	}
+
+	// or refuse it
+	dnsRefused.add(1)
+	server.reply(conn, addr, header, question, dnsmessage.RCodeRefused, nil)
+
+}
+
+// get the addresses to answer with for an endpoint host, asked
+// for by the console at addr
+func (server *dnsServer) addresses(addr net.Addr, name string) []net.IP {
+
+	// point it at maryo
+	if server.answer == "self" {
+
+		// there is only the one
+		return []net.IP{server.self}
+
+	}
+
+	// find the target, the console's own first
+	target, ok := server.consoles.endpointAt(stripHostPort(addr.String()), name)
+	if !ok {
+
+		// then everyone's
+		for host, value := range server.endpoints {
+
+			// check it
+			if hostMatches(host, name) {
+
+				// use it
+				target, _ = value.(string)
+				break
+
+			}
+
+		}
+
+	}
+	target = stripHostPort(target)
+
+	// it may already be an address
+	if ip := net.ParseIP(target); ip != nil {
+
+		// use it
+		return []net.IP{ip}
+
+	}
+
+	// look it up
+	ips, err := net.LookupIP(target)
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: couldn't look up %s, the target of %s: %s\n", target, name, err.Error())
+		return nil
+
+	}
+
+	// return them
+	return ips
+
+}
+
+// send a reply with the addresses that fit the question
+func (server *dnsServer) reply(conn net.PacketConn, addr net.Addr, query dnsmessage.Header, question dnsmessage.Question, rcode dnsmessage.RCode, ips []net.IP) {
+
+	// start the reply
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+
+		ID:                 query.ID,
+		Response:           true,
+		Authoritative:      rcode == dnsmessage.RCodeSuccess,
+		RecursionDesired:   query.RecursionDesired,
+		RecursionAvailable: server.upstream != "",
+		RCode:              rcode,
+	})
+	builder.EnableCompression()
+	builder.StartQuestions()
+	builder.Question(question)
+	builder.StartAnswers()
+
+	// add the addresses of the right kind
+	resource := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: dnsTTL}
+	for _, ip := range ips {
+
+		// ipv4 for A
+		if ip4 := ip.To4(); (ip4 != nil) && (question.Type == dnsmessage.TypeA) {
+
+			// add it
+			var a dnsmessage.AResource
+			copy(a.A[:], ip4)
+			builder.AResource(resource, a)
+
+		// ipv6 for AAAA
+		} else if (ip.To4() == nil) && (question.Type == dnsmessage.TypeAAAA) {
+
+			// add it
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip.To16())
+			builder.AAAAResource(resource, aaaa)
+
+		}
+
+	}
+
+	// send it
+	reply, err := builder.Finish()
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: error while building a dns reply: %s\n", err.Error())
+		return
+
+	}
+	conn.WriteTo(reply, addr)
+
+}
+
+// send a query to the upstream dns server, and get its reply
+func (server *dnsServer) forward(query []byte) ([]byte, error) {
+
+	// connect to it
+	conn, err := net.DialTimeout("udp", server.upstream, dnsUpstreamTimeout)
+	if err != nil {
+
+		// return the error
+		return nil, err
+
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsUpstreamTimeout))
+
+	// ask it
+	if _, err := conn.Write(query); err != nil {
+
+		// return the error
+		return nil, err
+
+	}
+
+	// get the reply
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+
+		// return the error
+		return nil, err
+
+	}
+	return buf[:n], nil
+
+}
+
+// dns subcommand
+func dnsCommand(args []string) {
+
+	// flags for dns
+	flags := flag.NewFlagSet("dns", flag.ExitOnError)
+	configPath := flags.String("config", "maryo-data/config.json", "path of the config to use")
+	logging := flags.Bool("logging", false, "if set, the proxy will log all request data (only needed for debugging)")
+	flags.Parse(args)
+
+	// there has to be a config
+	if !doesFileExist(*configPath) || !checkJSONValidity(*configPath) {
+
+		// there isn't
+		fmt.Printf("[err]: %s is missing or invalid, run maryo setup first\n", *configPath)
+		os.Exit(1)
+
+	}
+
+	// start the proxy with dns
+	dnsMode = true
+	startProxy(*configPath, *logging, false)
+
+}
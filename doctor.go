@@ -0,0 +1,482 @@
+/*
+
+maryo/doctor.go
+
+checks everything maryo needs to work, and reports
+what is wrong
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// how close to expiring a certificate can be before we warn about it
+const certExpiryWarning = 30 * 24 * time.Hour
+
+// results of the checks the doctor has done
+type doctorReport struct {
+	passed int
+	failed int
+	warned int
+}
+
+// show a check that passed
+func (report *doctorReport) pass(check string, detail string) {
+
+	// count it
+	report.passed++
+
+	// show it
+	consoleSequence(fmt.Sprintf("  %s%s%s%s %s: %s\n", code("green"), code("bold"), utilIcons["success"], code("reset"), check, detail))
+
+}
+
+// show a check that failed
+func (report *doctorReport) fail(check string, detail string) {
+
+	// count it
+	report.failed++
+
+	// show it
+	consoleSequence(fmt.Sprintf("  %s%s%s%s %s: %s\n", code("red"), code("bold"), utilIcons["failiure"], code("reset"), check, detail))
+
+}
+
+// show a check that isn't a failure, but might be a problem
+func (report *doctorReport) warn(check string, detail string) {
+
+	// count it
+	report.warned++
+
+	// show it
+	consoleSequence(fmt.Sprintf("  %s%s%s%s %s: %s\n", code("yellow"), code("bold"), utilIcons["uncertain"], code("reset"), check, detail))
+
+}
+
+// doctor subcommand
+func doctorCommand(args []string) {
+
+	// flags for the doctor
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	configPath := flags.String("config", "maryo-data/config.json", "path of the config to check")
+	flags.Parse(args)
+
+	// set the terminal title
+	ttitle("maryo -> doctor")
+
+	// the report
+	report := &doctorReport{}
+
+	// check the config
+	fmt.Printf("-- config\n")
+	configData := doctorConfig(report, *configPath)
+
+	// check the certificates
+	fmt.Printf("-- certificates\n")
+	doctorCerts(report)
+
+	// check the network
+	fmt.Printf("-- network\n")
+	doctorNetwork(report, configData)
+
+	// the rest of the checks need a config
+	if configData != nil {
+
+		// check the targets
+		fmt.Printf("-- targets\n")
+		doctorTargets(report, configData)
+
+		// check that the CA can sign for them
+		fmt.Printf("-- interception\n")
+		doctorCA(report, configData)
+
+	}
+
+	// show the summary
+	fmt.Printf("-- summary\n")
+	fmt.Printf(" %d passed, %d failed, %d warnings\n", report.passed, report.failed, report.warned)
+
+	// exit with the right status
+	if report.failed != 0 {
+
+		// something is wrong
+		os.Exit(1)
+
+	}
+
+}
+
+// check that the config exists and looks right
+func doctorConfig(report *doctorReport, configPath string) map[string]interface{} {
+
+	// check if it exists
+	if !doesFileExist(configPath) {
+
+		// it doesn't
+		report.fail("config", fmt.Sprintf("%s does not exist, run maryo setup", configPath))
+		return nil
+
+	}
+
+	// check if it is valid JSON
+	if !checkJSONValidity(configPath) {
+
+		// it isn't
+		report.fail("config", fmt.Sprintf("%s is not valid JSON", configPath))
+		return nil
+
+	}
+
+	// load it
+	configData := readJSONFile(configPath)
+	report.pass("config", fmt.Sprintf("%s is valid JSON", configPath))
+
+	// check the config section
+	settings, ok := configData["config"].(map[string]interface{})
+	if !ok {
+
+		// it is missing
+		report.fail("config schema", "there is no \"config\" object")
+		return nil
+
+	}
+
+	// check the endpoints section
+	endpoints, ok := configData["endpoints"].(map[string]interface{})
+	if !ok {
+
+		// it is missing
+		report.fail("config schema", "there is no \"endpoints\" object")
+		return nil
+
+	}
+
+	// check decryptOutgoing
+	if decrypt, ok := settings["decryptOutgoing"].(string); !ok || ((decrypt != "true") && (decrypt != "false")) {
+
+		// it has to be a string
+		report.fail("config schema", "\"decryptOutgoing\" must be \"true\" or \"false\"")
+		return nil
+
+	}
+
+	// check each endpoint
+	for from, to := range endpoints {
+
+		// they all have to be strings
+		if target, ok := to.(string); !ok || (target == "") || (from == "") {
+
+			// it isn't
+			report.fail("config schema", fmt.Sprintf("the endpoint %s must redirect to a host", from))
+			return nil
+
+		}
+
+	}
+
+	// warn if nothing is redirected
+	if len(endpoints) == 0 {
+
+		// that's probably a mistake
+		report.warn("config schema", "there are no endpoints, nothing will be redirected")
+
+	} else {
+
+		// it looks right
+		report.pass("config schema", fmt.Sprintf("%d endpoint(s)", len(endpoints)))
+
+	}
+
+	// return the config
+	return configData
+
+}
+
+// check the certificate and key pair
+func doctorCerts(report *doctorReport) {
+
+	// check that they exist
+	if !doesFileExist("maryo-data/cert.pem") || !doesFileExist("maryo-data/cert.key") {
+
+		// they don't
+		report.fail("cert", "maryo-data/cert.pem or maryo-data/cert.key is missing, run maryo with --regencerts")
+		return
+
+	}
+
+	// check that they match
+	pair, err := tls.LoadX509KeyPair("maryo-data/cert.pem", "maryo-data/cert.key")
+	if err != nil {
+
+		// they don't
+		report.fail("cert", fmt.Sprintf("the cert and key don't load together: %s", err.Error()))
+		return
+
+	}
+	report.pass("cert", "the cert and key match")
+
+	// parse it to check when it expires
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+
+		// can't parse it
+		report.fail("cert expiry", fmt.Sprintf("the cert can't be parsed: %s", err.Error()))
+		return
+
+	}
+
+	// check the expiry
+	doctorExpiry(report, "cert expiry", cert)
+
+}
+
+// check when a certificate expires
+func doctorExpiry(report *doctorReport, check string, cert *x509.Certificate) {
+
+	// how long is left
+	left := time.Until(cert.NotAfter)
+
+	// check it
+	if time.Now().Before(cert.NotBefore) {
+
+		// not valid yet
+		report.fail(check, fmt.Sprintf("not valid until %s", cert.NotBefore.Format(time.RFC1123)))
+
+	} else if left <= 0 {
+
+		// expired
+		report.fail(check, fmt.Sprintf("expired on %s", cert.NotAfter.Format(time.RFC1123)))
+
+	} else if left < certExpiryWarning {
+
+		// expiring soon
+		report.warn(check, fmt.Sprintf("expires in %d day(s), on %s", int(left.Hours()/24), cert.NotAfter.Format(time.RFC1123)))
+
+	} else {
+
+		// fine
+		report.pass(check, fmt.Sprintf("valid until %s", cert.NotAfter.Format(time.RFC1123)))
+
+	}
+
+}
+
+// check the local network
+func doctorNetwork(report *doctorReport, configData map[string]interface{}) {
+
+	// check that the port is free
+	listener, err := net.Listen("tcp", strings.Join([]string{":", proxyPort}, ""))
+	if err != nil {
+
+		// it isn't
+		report.fail("port", fmt.Sprintf("port %s can't be used (is maryo already running?): %s", proxyPort, err.Error()))
+
+	} else {
+
+		// it is
+		listener.Close()
+		report.pass("port", fmt.Sprintf("port %s is free", proxyPort))
+
+	}
+
+	// check that we can get the local ip
+	addresses, err := listAddresses()
+	if err != nil {
+
+		// we can't
+		report.fail("local ip", fmt.Sprintf("couldn't list the network interfaces: %s", err.Error()))
+
+	} else if len(addresses) == 0 {
+
+		// there is no network
+		report.fail("local ip", "there are no network addresses, only this machine will be able to connect")
+
+	} else {
+
+		// pick one like the proxy would
+		preferred := getSetting(configData, "interface", "")
+		addr, ok := pickAddress(addresses, preferred)
+		if ok == false {
+
+			// the configured one isn't there
+			report.warn("local ip", fmt.Sprintf("the interface %s in the config was not found", preferred))
+
+		}
+
+		// show it
+		report.pass("local ip", addr.String())
+
+		// and the rest of them
+		for _, other := range addresses {
+
+			// skip the one we already showed
+			if other.ip.String() != addr.ip.String() {
+
+				// show it
+				fmt.Printf("    also reachable on %s\n", other.String())
+
+			}
+
+		}
+
+	}
+
+}
+
+// check that each target can be reached
+func doctorTargets(report *doctorReport, configData map[string]interface{}) {
+
+	// plain http is used when decrypting outgoing connections
+	decryptAll := configData["config"].(map[string]interface{})["decryptOutgoing"].(string)
+
+	// check each of them
+	for from, to := range configData["endpoints"].(map[string]interface{}) {
+
+		// get the target
+		target := to.(string)
+		check := fmt.Sprintf("%s -> %s", from, target)
+
+		// get how the proxy talks to it, which the endpoint can change
+		scheme, defaultPort := "https", "443"
+		if getEndpointSetting(configData, from, "decryptOutgoing", decryptAll) == "true" {
+
+			// plain http
+			scheme, defaultPort = "http", "80"
+
+		}
+
+		// add a port if it doesn't have one
+		address := target
+		if _, _, err := net.SplitHostPort(target); err != nil {
+
+			// add the default port
+			address = net.JoinHostPort(target, defaultPort)
+
+		}
+
+		// try to connect
+		conn, err := net.DialTimeout("tcp", address, testTimeout)
+		if err != nil {
+
+			// can't reach it
+			report.fail(check, fmt.Sprintf("can't connect to %s: %s", address, err.Error()))
+			continue
+
+		}
+		conn.Close()
+
+		// get the json
+		res, err := getWithTimeout(strings.Join([]string{scheme, "://", address, "/isthisworking"}, ""), testTimeout)
+		if err != nil {
+
+			// reachable, but no isthisworking
+			report.warn(check, fmt.Sprintf("reachable, but /isthisworking failed: %s", err.Error()))
+			continue
+
+		}
+
+		// parse it
+		var parsedRes isitworkingStruct
+		if (json.Unmarshal([]byte(res), &parsedRes) != nil) || (parsedRes.Server == "") {
+
+			// not the answer we want
+			report.warn(check, "reachable, but /isthisworking didn't answer with a server")
+			continue
+
+		}
+
+		// check it is the right server
+		if parsedRes.Server != from {
+
+			// it is a different one
+			report.warn(check, fmt.Sprintf("reachable, but /isthisworking says it is %s", parsedRes.Server))
+			continue
+
+		}
+
+		// it works
+		report.pass(check, "reachable, and /isthisworking answered")
+
+	}
+
+}
+
+// check that the CA can sign a certificate for each routed host
+func doctorCA(report *doctorReport, configData map[string]interface{}) {
+
+	// load the CA
+	ca, err := loadProxyCA(configData)
+	if err != nil {
+
+		// it doesn't load
+		report.fail("ca", fmt.Sprintf("the proxy CA doesn't load: %s", err.Error()))
+		return
+
+	}
+
+	// check when it expires
+	doctorExpiry(report, "ca expiry", ca.Leaf)
+
+	// the nintendo cert isn't marked as a CA, so normal clients won't
+	// accept what it signs. the console doesn't care, though
+	if !ca.Leaf.IsCA {
+
+		// let them know
+		report.warn("ca", fmt.Sprintf("%s is not marked as a CA, only clients that trust it directly will accept it", ca.Leaf.Subject.CommonName))
+
+	}
+
+	// check each host
+	for from := range configData["endpoints"].(map[string]interface{}) {
+
+		// sign a cert for it
+		leaf, err := signLeaf(&ca, from)
+		if err != nil {
+
+			// can't sign it
+			report.fail(from, fmt.Sprintf("the CA can't sign a certificate: %s", err.Error()))
+			continue
+
+		}
+
+		// check that the CA's signature is good
+		err = ca.Leaf.CheckSignature(leaf.Leaf.SignatureAlgorithm, leaf.Leaf.RawTBSCertificate, leaf.Leaf.Signature)
+		if err != nil {
+
+			// it isn't
+			report.fail(from, fmt.Sprintf("the signed certificate doesn't verify: %s", err.Error()))
+			continue
+
+		}
+
+		// check that it is for the right host
+		err = leaf.Leaf.VerifyHostname(from)
+		if err != nil {
+
+			// it isn't
+			report.fail(from, fmt.Sprintf("the signed certificate is for the wrong host: %s", err.Error()))
+			continue
+
+		}
+
+		// it works
+		report.pass(from, "the CA can sign a certificate")
+
+	}
+
+}
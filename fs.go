@@ -17,8 +17,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path/filepath"
-	"strings"
 )
 
 // create directory
@@ -58,22 +56,12 @@ func doesDirExist(dir string) bool {
 // check if file exists
 func doesFileExist(file string) bool {
 
-	// this gets the absolute path of the file
-	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	// check it from the working directory, which is where everything
+	// else reads and writes files from
+	_, err := os.Stat(file)
 
-	// this tells the program if it exists
-	_, err = os.Stat(strings.Join([]string{dir, "/", file}, ""))
-
-	// handle any errors
-	if err != nil {
-
-		// return false if it doesn't exist
-		return false
-
-	}
-
-	// then return true if it exists
-	return true
+	// it exists if there was no error
+	return err == nil
 
 }
 
@@ -168,6 +156,25 @@ func deleteFile(file string) {
 
 }
 
+// delete a directory and everything in it
+func removeDirectory(directory string) {
+
+	// delete the directory
+	err := os.RemoveAll(directory)
+
+	// handle errors
+	if err != nil {
+
+		// show error message
+		fmt.Printf("[err] : error deleting directory %s..", directory)
+
+		// show traceback
+		panic(err)
+
+	}
+
+}
+
 // write to file
 func writeFile(file string, data string) {
 
@@ -209,6 +216,43 @@ func writeByteToFile(file string, data []byte) {
 
 }
 
+// write byte to a file only we can read, for keys
+func writePrivateFile(file string, data []byte) {
+
+	// open it so only we can read it, even before anything is in it
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err == nil {
+
+		// it might have been there already, readable by everyone
+		err = out.Chmod(0600)
+		if err == nil {
+
+			// write to it
+			_, err = out.Write(data)
+
+		}
+		if closeErr := out.Close(); err == nil {
+
+			// closing it can fail too
+			err = closeErr
+
+		}
+
+	}
+
+	// handle errors
+	if err != nil {
+
+		// show error message
+		fmt.Printf("[err] : error writing to file %s.. (does it exist?)\n", file)
+
+		// show traceback
+		panic(err)
+
+	}
+
+}
+
 // check if file is valid JSON
 func checkJSONValidity(file string) bool {
 
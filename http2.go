@@ -0,0 +1,146 @@
+/*
+
+maryo/http2.go
+
+lets clients and servers that can speak http/2 use it, unless
+an endpoint is set not to
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"crypto/tls"
+	"fmt"
+	"net/http"
+)
+
+// the protocols offered to clients when http/2 is on, in order
+var http2Protos = []string{"h2", "http/1.1"}
+
+// turn http/2 on or off for a transport
+func setHTTP2(transport *http.Transport, on bool) {
+
+	// let go set it up when it is first used
+	transport.ForceAttemptHTTP2 = on
+	if on {
+
+		// it does that when this is nil
+		transport.TLSNextProto = nil
+		return
+
+	}
+
+	// an empty map keeps it from being set up, and only
+	// http/1.1 is asked for
+	transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	transport.TLSClientConfig.NextProtos = nil
+
+}
+
+// set up http/2 from the settings in the config. it is on unless
+// turned off for everything or for an endpoint
+func (u *upstreams) applyHTTP2(configData map[string]interface{}) {
+
+	// get the setting for everything
+	u.http2 = getSetting(configData, "http2", "true") == "true"
+	u.endpointHTTP2 = make(map[string]bool)
+	setHTTP2(u.base, u.http2)
+	for _, transport := range u.endpoints {
+
+		// and for the endpoints that have their own transport
+		setHTTP2(transport, u.http2)
+
+	}
+
+	// get the setting for each endpoint
+	for _, host := range endpointConfigHosts(configData) {
+
+		// get it
+		setting := getEndpointSetting(configData, host, "http2", "")
+		if setting == "" {
+
+			// it uses the setting for everything
+			continue
+
+		}
+		on := setting == "true"
+		u.endpointHTTP2[host] = on
+
+		// make sure it has its own transport
+		transport, ok := u.endpoints[host]
+		if !ok {
+
+			// copy the base
+			transport = copyTransport(u.base)
+			u.endpoints[host] = transport
+
+		}
+
+		// set it
+		setHTTP2(transport, on)
+
+	}
+
+}
+
+// check if http/2 can be used for a host, on either side
+func (u *upstreams) allowsHTTP2(host string) bool {
+
+	// check the endpoint
+	if on, ok := u.endpointHTTP2[u.configKey(host)]; ok {
+
+		// use its setting
+		return on
+
+	}
+
+	// use the setting for everything
+	return u.http2
+
+}
+
+// get the transport for a host that only uses http/1.1, for requests
+// that upgrade the connection, which http/2 can't do. each one is made
+// once, so its connections are kept and used again
+func (u *upstreams) http1Transport(host string) *http.Transport {
+
+	// get the one it is copied from
+	transport := u.transport(host)
+
+	// lock the copies
+	u.http1Lock.Lock()
+	defer u.http1Lock.Unlock()
+
+	// it might have been made already
+	if copied, ok := u.http1[transport]; ok {
+
+		// use it
+		return copied
+
+	}
+
+	// copy it, and turn http/2 off
+	copied := copyTransport(transport)
+	setHTTP2(copied, false)
+
+	// keep it
+	u.http1[transport] = copied
+
+	// return it
+	return copied
+
+}
+
+// log the protocol used on each side of a request
+func logProtocols(host string, consoleProto string, serverProto string) {
+
+	// log it
+	consoleSequence(fmt.Sprintf("-> %s%s%s used %s from the console, %s to the server\n", code("grey"), host, code("reset"), consoleProto, serverProto))
+	writeLog(fmt.Sprintf("-> %s used %s from the console, %s to the server\n", host, consoleProto, serverProto))
+
+}
@@ -0,0 +1,239 @@
+/*
+
+maryo/intercept.go
+
+hands connections that didn't come in through the http proxy
+(like socks5 ones) to it, so they go through the same rewriting,
+decrypting, and logging as everything else
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// a connection given to the proxy as if a CONNECT came in on it.
+// the proxy answers the CONNECT with a status line, which the client
+// didn't ask for, so it is swallowed
+type interceptConn struct {
+	net.Conn
+	once sync.Once
+}
+
+// write to the connection, dropping the proxy's answer
+func (conn *interceptConn) Write(data []byte) (int, error) {
+
+	// check if this is the answer
+	answered := false
+	conn.once.Do(func() { answered = true })
+	if !answered {
+
+		// it isn't, so just write it
+		return conn.Conn.Write(data)
+
+	}
+
+	// it is, so check it
+	if !bytes.HasPrefix(data, []byte("HTTP/1.0 200")) && !bytes.HasPrefix(data, []byte("HTTP/1.1 200")) {
+
+		// the proxy refused it
+		return 0, errors.New("the proxy refused the connection")
+
+	}
+
+	// the status line was swallowed
+	return len(data), nil
+
+}
+
+// a response writer that hands over the connection when the
+// proxy hijacks it, which is all it does for a CONNECT
+type hijackWriter struct {
+	conn   net.Conn
+	header http.Header
+}
+
+// get the headers
+func (w *hijackWriter) Header() http.Header {
+
+	// return them
+	return w.header
+
+}
+
+// write to the connection
+func (w *hijackWriter) Write(data []byte) (int, error) {
+
+	// write it
+	return w.conn.Write(data)
+
+}
+
+// the status is sent by the proxy itself
+func (w *hijackWriter) WriteHeader(status int) {}
+
+// hand over the connection
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+
+	// hand it over
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+
+}
+
+// give a connection to the proxy as a CONNECT to target. the client
+// has to have been told it worked already, if it needs to be
+func interceptConnect(proxy http.Handler, conn net.Conn, target string) {
+
+	// make the CONNECT
+	req := &http.Request{
+
+		Method:     "CONNECT",
+		URL:        &url.URL{Host: target},
+		Host:       target,
+		Header:     make(http.Header),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+
+	// give it to the proxy
+	proxy.ServeHTTP(&hijackWriter{conn: &interceptConn{Conn: conn}, header: make(http.Header)}, req)
+
+}
+
+// a listener that only has one connection, so an http server can
+// serve a connection that came from somewhere else
+type oneConnListener struct {
+	conn net.Conn
+	done chan struct{}
+	lock sync.Mutex
+}
+
+// a connection that lets its listener know when it is closed
+type listenedConn struct {
+	net.Conn
+	listener *oneConnListener
+	once     sync.Once
+}
+
+// close the connection, and the listener with it
+func (conn *listenedConn) Close() error {
+
+	// let the listener know
+	conn.once.Do(func() { close(conn.listener.done) })
+
+	// close it
+	return conn.Conn.Close()
+
+}
+
+// give out the connection the first time, then wait for it to close
+func (listener *oneConnListener) Accept() (net.Conn, error) {
+
+	// give it out if it hasn't been
+	listener.lock.Lock()
+	conn := listener.conn
+	listener.conn = nil
+	listener.lock.Unlock()
+	if conn != nil {
+
+		// give it out
+		return &listenedConn{Conn: conn, listener: listener}, nil
+
+	}
+
+	// wait for it to close
+	<-listener.done
+	return nil, io.EOF
+
+}
+
+// nothing to close, the connection closes itself
+func (listener *oneConnListener) Close() error {
+
+	// no errors
+	return nil
+
+}
+
+// the address of the listener, which is the connection's
+func (listener *oneConnListener) Addr() net.Addr {
+
+	// there is no real listener
+	return &net.TCPAddr{}
+
+}
+
+// serve plain http requests from a connection through the proxy.
+// requests without a host header are sent to target
+func interceptHTTP(proxy http.Handler, conn net.Conn, target string) {
+
+	// serve them
+	serveRequests(proxy, conn, "http", target)
+
+}
+
+// make a handler that makes urls absolute, like they would be if
+// they came through the proxy, and gives them to it. decrypted
+// connections always go to target, like goproxy does, and plain
+// ones go to their host header if they have one
+func absoluteRequests(proxy http.Handler, scheme string, target string) http.Handler {
+
+	// make it
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// make the url absolute
+		r.URL.Scheme = scheme
+		r.URL.Host = target
+		if (scheme == "http") && (r.Host != "") {
+
+			// use the host header
+			r.URL.Host = r.Host
+
+		}
+
+		// give it to the proxy
+		proxy.ServeHTTP(w, r)
+
+	})
+
+}
+
+// serve the http/1.1 requests on a connection through the proxy
+func serveRequests(proxy http.Handler, conn net.Conn, scheme string, target string) {
+
+	// make the server
+	server := &http.Server{IdleTimeout: idleTimeout, Handler: absoluteRequests(proxy, scheme, target)}
+
+	// serve it
+	server.Serve(&oneConnListener{conn: conn, done: make(chan struct{})})
+
+}
+
+// a connection with some of it already read into a buffer
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// read from the buffer first
+func (conn *bufferedConn) Read(data []byte) (int, error) {
+
+	// read it
+	return conn.reader.Read(data)
+
+}
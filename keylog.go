@@ -0,0 +1,83 @@
+/*
+
+maryo/keylog.go
+
+writes the secrets of every tls connection maryo makes
+in the format wireshark reads, for decrypting captures
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"fmt"
+	"os"
+	"sync"
+)
+
+// a key log that can be written to by many connections at once
+type keyLog struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// open a key log, adding to it if it already exists
+func openKeyLog(path string) (*keyLog, error) {
+
+	// open it so only we can read it
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+
+		// return the error
+		return nil, err
+
+	}
+
+	// return it
+	return &keyLog{file: file}, nil
+
+}
+
+// write a line to the key log
+func (log *keyLog) Write(data []byte) (int, error) {
+
+	// one connection at a time
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	// write it
+	return log.file.Write(data)
+
+}
+
+// close the key log, making sure everything is written
+func (log *keyLog) Close() error {
+
+	// wait for any writes
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	// write it out and close it
+	log.file.Sync()
+	return log.file.Close()
+
+}
+
+// show a warning that is hard to miss about the key log
+func warnKeyLog(path string) {
+
+	// show it
+	consoleSequence(fmt.Sprintf("%s%s", code("red"), code("bold")))
+	fmt.Printf("!! ---------------------------------------------------------- !!\n")
+	fmt.Printf("!! tls keys are being written to %s\n", path)
+	fmt.Printf("!! anyone with this file can decrypt captures of this proxy's\n")
+	fmt.Printf("!! traffic, including passwords and tokens. only use this for\n")
+	fmt.Printf("!! debugging, and delete the file when you are done.\n")
+	fmt.Printf("!! ---------------------------------------------------------- !!\n")
+	consoleSequence(code("reset"))
+
+}
@@ -0,0 +1,524 @@
+/*
+
+maryo/leafcache.go
+
+keeps the certificates signed for each host around, so
+they don't have to be signed again on every connection
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"container/list"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	// externals
+	"github.com/elazarl/goproxy"
+)
+
+// the defaults for the leaf cache settings
+const (
+	defaultLeafCacheSize = 256
+	defaultLeafCacheDir  = "maryo-data/leaf-cache"
+)
+
+// certificates this close to expiring are signed again
+const leafRenewBefore = 24 * time.Hour
+
+// metrics for the leaf cache
+var (
+	leafCacheHits      = newCounter("maryo_leaf_cache_hits_total", "leaf certificates found in memory")
+	leafCacheDiskHits  = newCounter("maryo_leaf_cache_disk_hits_total", "leaf certificates loaded from the disk cache")
+	leafCacheMisses    = newCounter("maryo_leaf_cache_misses_total", "leaf certificates that had to be signed")
+	leafCacheEvictions = newCounter("maryo_leaf_cache_evictions_total", "leaf certificates dropped from memory to make room")
+	leafCacheHitRatio  = newGaugeFunc("maryo_leaf_cache_hit_ratio", "share of leaf certificates that didn't have to be signed", leafCacheHitRate)
+)
+
+// an entry in the cache
+type leafEntry struct {
+	host string
+	cert *tls.Certificate
+}
+
+// a certificate that is being signed, so other connections
+// to the same host can wait for it instead of signing their own
+type leafPending struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// lru cache of signed certificates, keyed by host
+type leafCache struct {
+	ca      *tls.Certificate
+	size    int
+	dir     string
+	lock    sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+	pending map[string]*leafPending
+	keyLog  io.Writer
+}
+
+// make a leaf cache. if dir isn't empty, certificates are
+// also kept there between runs
+func newLeafCache(ca *tls.Certificate, size int, dir string) *leafCache {
+
+	// make it
+	cache := &leafCache{
+
+		ca:      ca,
+		size:    size,
+		dir:     dir,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		pending: make(map[string]*leafPending),
+	}
+
+	// make sure the disk cache folder exists
+	if (dir != "") && (doesDirExist(dir) == false) {
+
+		// make it if it doesn't
+		makeDirectory(dir)
+
+	}
+
+	// keys cached by older versions could be read by anyone
+	if dir != "" {
+
+		// make them only readable by us
+		files, _ := filepath.Glob(filepath.Join(dir, "*.pem"))
+		for _, file := range files {
+
+			// fix it
+			os.Chmod(file, 0600)
+
+		}
+
+	}
+
+	// return it
+	return cache
+
+}
+
+// make the leaf cache from the settings in the config
+func leafCacheFromConfig(configData map[string]interface{}, ca *tls.Certificate) *leafCache {
+
+	// get the size
+	size, err := strconv.Atoi(getSetting(configData, "leafCacheSize", strconv.Itoa(defaultLeafCacheSize)))
+	if (err != nil) || (size < 1) {
+
+		// use the default
+		fmt.Printf("[err]: leafCacheSize must be a number above zero, using %d\n", defaultLeafCacheSize)
+		size = defaultLeafCacheSize
+
+	}
+
+	// only use the disk if asked to
+	dir := ""
+	if getSetting(configData, "leafCacheDisk", "false") == "true" {
+
+		// get the folder
+		dir = getSetting(configData, "leafCacheDir", defaultLeafCacheDir)
+
+	}
+
+	// make it
+	return newLeafCache(ca, size, dir)
+
+}
+
+// get the certificate for a host, signing it if needed
+func (cache *leafCache) get(host string) (*tls.Certificate, error) {
+
+	// strip the port
+	host = stripHostPort(host)
+
+	// lock the cache
+	cache.lock.Lock()
+
+	// check memory first
+	if element, ok := cache.entries[host]; ok {
+
+		// make sure it is still good
+		entry := element.Value.(*leafEntry)
+		if time.Until(entry.cert.Leaf.NotAfter) > leafRenewBefore {
+
+			// it is
+			cache.order.MoveToFront(element)
+			cache.lock.Unlock()
+			leafCacheHits.add(1)
+			return entry.cert, nil
+
+		}
+
+		// it is about to expire
+		cache.order.Remove(element)
+		delete(cache.entries, host)
+
+	}
+
+	// wait for it if another connection is already signing it
+	if pending, ok := cache.pending[host]; ok {
+
+		// wait
+		cache.lock.Unlock()
+		<-pending.done
+		leafCacheHits.add(1)
+		return pending.cert, pending.err
+
+	}
+
+	// sign it ourselves, with the CA we have right now
+	pending := &leafPending{done: make(chan struct{})}
+	cache.pending[host] = pending
+	ca := cache.ca
+	cache.lock.Unlock()
+
+	// load it from the disk, or sign it
+	pending.cert, pending.err = cache.load(host, ca)
+
+	// put it in the cache
+	cache.lock.Lock()
+	delete(cache.pending, host)
+	if (pending.err == nil) && (ca == cache.ca) {
+
+		// add it
+		cache.add(host, pending.cert)
+
+	}
+	cache.lock.Unlock()
+
+	// let anything waiting know
+	close(pending.done)
+
+	// return it
+	return pending.cert, pending.err
+
+}
+
+// add a certificate to memory. the cache must be locked
+func (cache *leafCache) add(host string, cert *tls.Certificate) {
+
+	// add it to the front
+	cache.entries[host] = cache.order.PushFront(&leafEntry{host: host, cert: cert})
+
+	// drop the oldest ones if there are too many
+	for cache.order.Len() > cache.size {
+
+		// drop it
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*leafEntry).host)
+		leafCacheEvictions.add(1)
+
+	}
+
+}
+
+// get a certificate from the disk cache, or sign a new one
+func (cache *leafCache) load(host string, ca *tls.Certificate) (*tls.Certificate, error) {
+
+	// try the disk
+	if cache.dir != "" {
+
+		// read it
+		if cert, ok := cache.readDisk(host, ca); ok {
+
+			// it was there
+			leafCacheDiskHits.add(1)
+			return cert, nil
+
+		}
+
+	}
+
+	// sign a new one
+	leafCacheMisses.add(1)
+	cert, err := signLeaf(ca, host)
+	if err != nil {
+
+		// return the error
+		return nil, err
+
+	}
+
+	// save it to the disk
+	if cache.dir != "" {
+
+		// write it
+		cache.writeDisk(host, &cert)
+
+	}
+
+	// return it
+	return &cert, nil
+
+}
+
+// get the file a host's certificate is kept in
+func (cache *leafCache) file(host string) string {
+
+	// only keep characters that are safe in a file name
+	name := strings.Map(func(r rune) rune {
+
+		// letters, numbers, dots, and dashes are fine
+		if ((r >= 'a') && (r <= 'z')) || ((r >= 'A') && (r <= 'Z')) || ((r >= '0') && (r <= '9')) || (r == '.') || (r == '-') {
+
+			// keep it
+			return r
+
+		}
+
+		// replace anything else
+		return '_'
+
+	}, host)
+
+	// return the path
+	return filepath.Join(cache.dir, strings.Join([]string{name, ".pem"}, ""))
+
+}
+
+// read a host's certificate from the disk cache
+func (cache *leafCache) readDisk(host string, ca *tls.Certificate) (*tls.Certificate, bool) {
+
+	// make sure it is there
+	file := cache.file(host)
+	if !doesFileExist(file) {
+
+		// it isn't
+		return nil, false
+
+	}
+
+	// the file has the certificate then the key
+	data := readFileByte(file)
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+
+		// it is broken, so sign a new one
+		return nil, false
+
+	}
+
+	// parse it
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+
+		// it is broken, so sign a new one
+		return nil, false
+
+	}
+
+	// make sure it is for this host, hasn't expired, and was
+	// signed by the CA we are using now
+	if (cert.Leaf.VerifyHostname(host) != nil) || (time.Until(cert.Leaf.NotAfter) <= leafRenewBefore) || (ca.Leaf.CheckSignature(cert.Leaf.SignatureAlgorithm, cert.Leaf.RawTBSCertificate, cert.Leaf.Signature) != nil) {
+
+		// it isn't good anymore
+		return nil, false
+
+	}
+
+	// add the CA to the chain, like signLeaf does
+	cert.Certificate = append(cert.Certificate, ca.Certificate[0])
+
+	// return it
+	return &cert, true
+
+}
+
+// write a host's certificate to the disk cache
+func (cache *leafCache) writeDisk(host string, cert *tls.Certificate) {
+
+	// encode the key
+	keyBlock, err := marshalKeyPEM(cert.PrivateKey)
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: couldn't cache the certificate for %s: %s\n", host, err.Error())
+		return
+
+	}
+
+	// write the certificate then the key
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	data = append(data, pem.EncodeToMemory(keyBlock)...)
+
+	// open it so only we can read it, since it has the key in it
+	file, err := os.OpenFile(cache.file(host), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: couldn't cache the certificate for %s: %s\n", host, err.Error())
+		return
+
+	}
+	defer file.Close()
+
+	// files cached before this might be readable by anyone
+	file.Chmod(0600)
+
+	// write it
+	if _, err := file.Write(data); err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: couldn't cache the certificate for %s: %s\n", host, err.Error())
+
+	}
+
+}
+
+// sign certificates for hosts ahead of time
+func (cache *leafCache) pregenerate(hosts []string) int {
+
+	// count the ones that worked
+	count := 0
+
+	// sign each of them
+	for _, host := range hosts {
+
+		// patterns aren't hosts, so they are signed when they are used
+		if strings.HasPrefix(host, "*.") {
+
+			// skip it
+			continue
+
+		}
+
+		// sign it
+		if _, err := cache.get(host); err != nil {
+
+			// show an error message
+			fmt.Printf("[err]: couldn't sign a certificate for %s: %s\n", host, err.Error())
+			continue
+
+		}
+		count++
+
+	}
+
+	// return the count
+	return count
+
+}
+
+// switch to another CA, dropping everything signed by the old one
+func (cache *leafCache) swapCA(ca *tls.Certificate) {
+
+	// lock the cache
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	// switch it
+	cache.ca = ca
+
+	// drop everything in memory. the disk cache is checked
+	// against the CA when it is read, so it can stay
+	cache.order.Init()
+	cache.entries = make(map[string]*list.Element)
+
+}
+
+// get the current CA
+func (cache *leafCache) currentCA() *tls.Certificate {
+
+	// lock the cache
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	// return it
+	return cache.ca
+
+}
+
+// count the certificates in memory that expire within a duration
+func (cache *leafCache) expiring(within time.Duration) int {
+
+	// lock the cache
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	// count them
+	count := 0
+	for element := cache.order.Front(); element != nil; element = element.Next() {
+
+		// check it
+		if time.Until(element.Value.(*leafEntry).cert.Leaf.NotAfter) < within {
+
+			// count it
+			count++
+
+		}
+
+	}
+
+	// return the count
+	return count
+
+}
+
+// get how many certificates are in memory
+func (cache *leafCache) length() float64 {
+
+	// lock the cache
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	// return the count
+	return float64(cache.order.Len())
+
+}
+
+// get the hit rate of the cache, counting disk hits as hits
+func leafCacheHitRate() float64 {
+
+	// get the counts
+	hits := leafCacheHits.current() + leafCacheDiskHits.current()
+	total := hits + leafCacheMisses.current()
+
+	// nothing has been asked for yet
+	if total == 0 {
+
+		// call it zero
+		return 0
+
+	}
+
+	// return the rate
+	return hits / total
+
+}
+
+// get the tls config for a connection, for goproxy's connect actions
+func (cache *leafCache) tlsConfig(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+
+	// get the certificate
+	cert, err := cache.get(host)
+	if err != nil {
+
+		// return the error
+		ctx.Warnf("cannot sign a certificate for %s: %s", host, err)
+		return nil, err
+
+	}
+
+	// return the config, which doesn't check the certificates
+	// of upstream servers, like goproxy's
+	return &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{*cert}, KeyLogWriter: cache.keyLog}, nil
+
+}
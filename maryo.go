@@ -16,17 +16,45 @@ import (
 	"os"
 )
 
+// subcommands that can be passed as the first argument
+var subcommands = map[string]func(args []string){
+	"setup":        setupCommand,
+	"template":     templateCommand,
+	"doctor":       doctorCommand,
+	"connect-info": connectInfoCommand,
+	"patch":        patchCommand,
+	"cert":         certCommand,
+	"dns":          dnsCommand,
+}
+
 // main function
 func main() {
 
 	// reset term colors
 	consoleSequence(fmt.Sprintf("%s", code("reset")))
 
+	// check for a subcommand
+	if len(os.Args) > 1 {
+
+		// see if it is one we know
+		if subcommand, isItIn := subcommands[os.Args[1]]; isItIn {
+
+			// run it with the rest of the arguments
+			subcommand(os.Args[2:])
+
+			// and exit
+			os.Exit(0)
+
+		}
+
+	}
+
 	// parse some flags here
 	config := flag.String("config", "maryo-data/config.json", "value for config file path (default is maryo/config.json)")
 	logging := flag.Bool("logging", false, "if set, the proxy will log all request data (only needed for debugging)")
 	doSetup := flag.Bool("setup", false, "if set, maryo will go through setup again")
 	generateCerts := flag.Bool("regencerts", false, "if set, maryo will generate self-signed certificates for private use")
+	connectInfo := flag.Bool("connect-info", false, "if set, maryo will show how to connect your console when it starts")
 	flag.Parse()
 
 	// set window title
@@ -131,7 +159,7 @@ func main() {
 		} else {
 
 			// start the proxy
-			startProxy(*config, *logging)
+			startProxy(*config, *logging, *connectInfo)
 
 		}
 
@@ -0,0 +1,121 @@
+/*
+
+maryo/metrics.go
+
+counters and gauges for what the proxy is doing, shown
+in the prometheus text format at /metrics
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// a single metric. counters and gauges that are set keep
+// their value here, and gauges that are computed have a func
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	value int64
+	get   func() float64
+}
+
+// every metric, in the order they were made
+var (
+	metricsLock sync.Mutex
+	metricList  []*metric
+)
+
+// add a metric to the list
+func registerMetric(m *metric) *metric {
+
+	// lock the list
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	// add it
+	metricList = append(metricList, m)
+
+	// return it
+	return m
+
+}
+
+// make a counter
+func newCounter(name string, help string) *metric {
+
+	// register it
+	return registerMetric(&metric{name: name, help: help, kind: "counter"})
+
+}
+
+// make a gauge that is computed whenever it is shown
+func newGaugeFunc(name string, help string, get func() float64) *metric {
+
+	// register it
+	return registerMetric(&metric{name: name, help: help, kind: "gauge", get: get})
+
+}
+
+// add to a counter
+func (m *metric) add(n int64) {
+
+	// add it
+	atomic.AddInt64(&m.value, n)
+
+}
+
+// get the current value of a metric
+func (m *metric) current() float64 {
+
+	// computed gauges
+	if m.get != nil {
+
+		// compute it
+		return m.get()
+
+	}
+
+	// everything else
+	return float64(atomic.LoadInt64(&m.value))
+
+}
+
+// write every metric in the prometheus text format
+func writeMetrics(w io.Writer) {
+
+	// lock the list
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	// write each of them
+	for _, m := range metricList {
+
+		// write it
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+		fmt.Fprintf(w, "%s %g\n", m.name, m.current())
+
+	}
+
+}
+
+// handler for /metrics
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+
+	// show the metrics
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+
+}
@@ -0,0 +1,82 @@
+/*
+
+maryo/mitm.go
+
+decrypts connections for goproxy, serving the requests in them
+with an http server so they can be upgraded and streamed
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	// externals
+	"github.com/elazarl/goproxy"
+	"golang.org/x/net/http2"
+)
+
+// make goproxy hand decrypted connections to handler. its own way of
+// decrypting them closes every connection after one response, can't
+// hand the connection over for websockets, and only speaks http/1.1
+func useMitm(handler http.Handler, cache *leafCache, upstream *upstreams) {
+
+	// take over the connection instead of having goproxy decrypt it
+	goproxy.MitmConnect = &goproxy.ConnectAction{Action: goproxy.ConnectHijack, TLSConfig: cache.tlsConfig, Hijack: func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+
+		// get the certificate for the host
+		config, err := cache.tlsConfig(req.URL.Host, ctx)
+		if err != nil {
+
+			// show an error message
+			fmt.Printf("[err]: couldn't get a certificate for %s: %s\n", req.URL.Host, err.Error())
+			client.Close()
+			return
+
+		}
+
+		// offer http/2 if the host can use it
+		if upstream.allowsHTTP2(req.URL.Host) {
+
+			// offer it
+			config.NextProtos = http2Protos
+
+		}
+
+		// don't hold up the connect
+		go func() {
+
+			// decrypt it
+			conn := tls.Server(client, config)
+			if err := conn.Handshake(); err != nil {
+
+				// show an error message
+				fmt.Printf("[err]: couldn't decrypt the connection to %s (does the console trust the CA?): %s\n", req.URL.Host, err.Error())
+				client.Close()
+				return
+
+			}
+
+			// serve the requests in it, with the protocol the client picked
+			if conn.ConnectionState().NegotiatedProtocol == "h2" {
+
+				// serve it over http/2
+				server := &http2.Server{IdleTimeout: idleTimeout}
+				server.ServeConn(conn, &http2.ServeConnOpts{Handler: absoluteRequests(handler, "https", req.URL.Host)})
+				return
+
+			}
+			serveRequests(handler, conn, "https", req.URL.Host)
+
+		}()
+
+	}}
+
+}
@@ -16,10 +16,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
 /* net utils */
@@ -149,3 +152,196 @@ func get(url string) (string, error) {
 	return ret, nil
 	
 }
+
+// function to get data from a URL, giving up after a timeout
+func getWithTimeout(url string, timeout time.Duration) (string, error) {
+
+	// make a client that gives up
+	client := &http.Client{Timeout: timeout}
+
+	// attempt to download the contents
+	res, err := client.Get(url)
+
+	// error handling
+	if err != nil {
+
+		// return an empty string, and the error
+		return "", err
+
+	}
+
+	// close request body stream once finished
+	defer res.Body.Close()
+
+	// read all data from body
+	data, err := ioutil.ReadAll(res.Body)
+
+	// error handling
+	if err != nil {
+
+		// return an empty string, and the error
+		return "", err
+
+	}
+
+	// return the request response
+	return string(data[:]), nil
+
+}
+
+// an address of this machine, and the interface it is on
+type localAddress struct {
+	iface string
+	ip    net.IP
+	mask  net.IPMask
+}
+
+// show the address as a string
+func (addr localAddress) String() string {
+
+	// ip (interface)
+	return fmt.Sprintf("%s (%s)", addr.ip.String(), addr.iface)
+
+}
+
+// how good an address is for the console to connect to,
+// lower is better
+func (addr localAddress) rank() int {
+
+	// ipv4 addresses first, private ones before anything else
+	if ip4 := addr.ip.To4(); ip4 != nil {
+
+		// check the ranges
+		if (ip4[0] == 10) || ((ip4[0] == 172) && (ip4[1]&0xf0 == 16)) || ((ip4[0] == 192) && (ip4[1] == 168)) {
+
+			// private
+			return 0
+
+		} else if (ip4[0] == 169) && (ip4[1] == 254) {
+
+			// link-local, probably not configured
+			return 3
+
+		}
+
+		// public
+		return 1
+
+	}
+
+	// then ipv6
+	return 2
+
+}
+
+// list the usable addresses of this machine without
+// contacting anything outside of it
+func listAddresses() ([]localAddress, error) {
+
+	// list of addresses
+	addresses := []localAddress{}
+
+	// get the interfaces
+	ifaces, err := net.Interfaces()
+
+	// handle errors
+	if err != nil {
+
+		// return the error
+		return nil, err
+
+	}
+
+	// look at each of them
+	for _, iface := range ifaces {
+
+		// skip interfaces that are down or loopback
+		if (iface.Flags&net.FlagUp == 0) || (iface.Flags&net.FlagLoopback != 0) {
+
+			// skip it
+			continue
+
+		}
+
+		// get its addresses
+		addrs, err := iface.Addrs()
+
+		// skip it if there is an error
+		if err != nil {
+
+			// skip it
+			continue
+
+		}
+
+		// look at each address
+		for _, addr := range addrs {
+
+			// only look at ip addresses
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() {
+
+				// skip it
+				continue
+
+			}
+
+			// link-local ipv6 addresses can't be used without a zone
+			if (ipnet.IP.To4() == nil) && ipnet.IP.IsLinkLocalUnicast() {
+
+				// skip it
+				continue
+
+			}
+
+			// add it
+			addresses = append(addresses, localAddress{iface: iface.Name, ip: ipnet.IP, mask: ipnet.Mask})
+
+		}
+
+	}
+
+	// put the best ones first
+	sort.SliceStable(addresses, func(i, j int) bool { return addresses[i].rank() < addresses[j].rank() })
+
+	// return the addresses
+	return addresses, nil
+
+}
+
+// pick the address to use. the preferred one can be an
+// interface name or an ip, and if it isn't given (or
+// isn't found), the best address is used. the bool is
+// false if the preferred one wasn't found
+func pickAddress(addresses []localAddress, preferred string) (localAddress, bool) {
+
+	// look for the preferred one
+	if preferred != "" {
+
+		// check each address
+		for _, addr := range addresses {
+
+			// check the interface and ip
+			if (addr.iface == preferred) || (addr.ip.String() == preferred) {
+
+				// found it
+				return addr, true
+
+			}
+
+		}
+
+	}
+
+	// no addresses at all
+	if len(addresses) == 0 {
+
+		// nothing to pick
+		return localAddress{}, false
+
+	}
+
+	// use the best one
+	return addresses[0], (preferred == "")
+
+}
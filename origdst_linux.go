@@ -0,0 +1,75 @@
+/*
+
+maryo/origdst_linux.go
+
+gets where a connection redirected with iptables was going
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// the socket option netfilter keeps the original address in
+const soOriginalDst = 80
+
+// get the address a connection was sent to before it was redirected.
+// connections that weren't redirected give their own local address
+func originalDestination(conn net.Conn) (string, error) {
+
+	// it has to be tcp
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+
+		// it isn't
+		return "", errors.New("not a tcp connection")
+
+	}
+
+	// get the socket
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+
+		// return the error
+		return "", err
+
+	}
+
+	// ask netfilter. the address comes back as a sockaddr_in, which
+	// is the same size as the struct this call reads
+	var addr *syscall.IPv6Mreq
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+
+		// get it
+		addr, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+
+	})
+	if err != nil {
+
+		// return the error
+		return "", err
+
+	}
+	if sockErr != nil {
+
+		// return the error
+		return "", sockErr
+
+	}
+
+	// the port is big endian, followed by the ip
+	port := int(addr.Multiaddr[2])<<8 | int(addr.Multiaddr[3])
+	ip := net.IPv4(addr.Multiaddr[4], addr.Multiaddr[5], addr.Multiaddr[6], addr.Multiaddr[7])
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+
+}
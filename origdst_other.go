@@ -0,0 +1,28 @@
+// +build !linux
+
+/*
+
+maryo/origdst_other.go
+
+redirected connections can only be followed on linux
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"errors"
+	"net"
+)
+
+// there's no way to get the original address here
+func originalDestination(conn net.Conn) (string, error) {
+
+	// so don't
+	return "", errors.New("finding where a redirected connection was going only works on linux")
+
+}
@@ -0,0 +1,185 @@
+/*
+
+maryo/pac.go
+
+serves a proxy auto-config file that only sends the hosts in
+the endpoints table through maryo, for pcs and emulators
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a pac file, made again whenever the config changes
+type pacFile struct {
+	configPath string
+	ip         string
+	lock       sync.Mutex
+	modTime    time.Time
+	script     string
+}
+
+// make the pac script for the hosts in a config
+func makePAC(configData map[string]interface{}, ip string) string {
+
+	// get the hosts, in order so the file doesn't change for nothing
+	hosts := []string{}
+	for _, host := range routedHosts(configData) {
+
+		// add it
+		hosts = append(hosts, strconv.Quote(strings.ToLower(host)))
+
+	}
+	sort.Strings(hosts)
+
+	// write the script. patterns like *.example.com work with shExpMatch
+	return fmt.Sprintf(`// made by maryo, sends the hosts in its endpoints table through it
+function FindProxyForURL(url, host) {
+	var hosts = [%s];
+	host = host.toLowerCase();
+	for (var i = 0; i < hosts.length; i++) {
+		if (shExpMatch(host, hosts[i])) {
+			return "PROXY %s:%s";
+		}
+	}
+	return "DIRECT";
+}
+`, strings.Join(hosts, ", "), ip, proxyPort)
+
+}
+
+// get the script, making it again if the config changed
+func (pac *pacFile) get() string {
+
+	// only one at a time
+	pac.lock.Lock()
+	defer pac.lock.Unlock()
+
+	// check if the config changed
+	info, err := os.Stat(pac.configPath)
+	if (err != nil) || info.ModTime().Equal(pac.modTime) {
+
+		// it didn't, or it can't be read, so use the last one
+		return pac.script
+
+	}
+
+	// don't use it if it is broken, it is probably being saved
+	if !checkJSONValidity(pac.configPath) {
+
+		// show an error message
+		fmt.Printf("[err]: %s is invalid, still serving the last pac file\n", pac.configPath)
+		return pac.script
+
+	}
+
+	// make it again
+	pac.script = makePAC(readJSONFile(pac.configPath), pac.ip)
+	pac.modTime = info.ModTime()
+	return pac.script
+
+}
+
+// serve the script
+func (pac *pacFile) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	// send it
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, pac.get())
+
+}
+
+// add the pac file to the info mux, if the config wants it
+func handlePAC(mux *http.ServeMux, configPath string, configData map[string]interface{}, ip string, access *accessControl) {
+
+	// it is on unless it is turned off
+	if getSetting(configData, "servePAC", "true") != "true" {
+
+		// it is off
+		return
+
+	}
+
+	// make it
+	pac := &pacFile{configPath: configPath, ip: ip, script: makePAC(configData, ip)}
+	if info, err := os.Stat(configPath); err == nil {
+
+		// remember when it was made
+		pac.modTime = info.ModTime()
+
+	}
+
+	// serve it
+	mux.Handle("/proxy.pac", pac)
+	consoleSequence(fmt.Sprintf("-> serving a pac file on %shttp://%s:%s/proxy.pac%s\n", code("green"), ip, proxyPort, code("reset")))
+
+	// and for wpad, if asked to
+	if getSetting(configData, "serveWPAD", "false") == "true" {
+
+		// serve it here too, and on the port browsers look for it on
+		mux.Handle("/wpad.dat", pac)
+		startWPAD(configData, pac, ip, access)
+
+	}
+
+}
+
+// serve the pac file as wpad.dat on its own port. browsers look for it at
+// http://wpad.<their domain>/wpad.dat, so that name has to point at maryo
+func startWPAD(configData map[string]interface{}, pac *pacFile, ip string, access *accessControl) {
+
+	// get the port, which browsers expect to be 80
+	port := getSetting(configData, "wpadPort", "80")
+	page := fmt.Sprintf("http://%s:%s/wpad.dat", ip, proxyPort)
+
+	// the transparent listener might want it
+	transparent := dnsMode || (getSetting(configData, "dnsMode", "false") == "true") || (getSetting(configData, "transparentMode", "false") == "true")
+	if transparent && (getSetting(configData, "transparentHTTPPort", "80") == port) {
+
+		// leave it to that
+		consoleSequence(fmt.Sprintf("-> %sthe transparent listener uses port %s, so wpad is only at %s (set wpadPort to serve it somewhere else)%s\n", code("yellow"), port, page, code("reset")))
+		return
+
+	}
+
+	// listen
+	listener, err := net.Listen("tcp", strings.Join([]string{":", port}, ""))
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: couldn't serve wpad on port %s: %s\n", port, err.Error())
+		consoleSequence(fmt.Sprintf("-> %sclients will have to be given %s by hand%s\n", code("yellow"), page, code("reset")))
+		return
+
+	}
+
+	// stop it with the proxy
+	currentSession.closeOnShutdown(func() { listener.Close() })
+
+	// only wpad.dat is served there
+	mux := http.NewServeMux()
+	mux.Handle("/wpad.dat", pac)
+	server := &http.Server{Handler: mux}
+	go server.Serve(access.listener(listener))
+
+	// let the user know
+	consoleSequence(fmt.Sprintf("-> serving wpad on %shttp://%s:%s/wpad.dat%s, point wpad.<your domain> at %s for browsers to find it\n", code("green"), ip, port, code("reset"), ip))
+	writeLog(fmt.Sprintf("-> serving wpad on port :%s\n", port))
+
+}
@@ -0,0 +1,277 @@
+/*
+
+maryo/patch.go
+
+encryption for the romfs certificate patch. the format written
+here is maryo's own guess, and hasn't been checked against how
+the title actually reads its romfs, so the patch is experimental
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// the title the patch is for, and the files in its romfs
+const (
+	patchTitle    = "0004001b00010002"
+	patchCertFile = "ctr-common-1-cert.bin"
+	patchKeyFile  = "ctr-common-1-key.bin"
+)
+
+// read the 0x0D slot key. it can either be the raw 16 bytes,
+// or those bytes written out in hex
+func readSlotKey(file string) ([]byte, error) {
+
+	// read the file
+	data := readFileByte(file)
+
+	// check for the raw key first
+	if len(data) == aes.BlockSize {
+
+		// it is the key
+		return data, nil
+
+	}
+
+	// then try it as hex
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if (err == nil) && (len(key) == aes.BlockSize) {
+
+		// it is the key
+		return key, nil
+
+	}
+
+	// it is the wrong size
+	return nil, fmt.Errorf("%s is %d bytes, but the slot key has to be %d bytes (or %d hex characters)", file, len(data), aes.BlockSize, aes.BlockSize*2)
+
+}
+
+// read the first block out of a pem file
+func readPEMFile(file string) ([]byte, error) {
+
+	// decode it
+	block, _ := pem.Decode(readFileByte(file))
+
+	// make sure it is pem
+	if block == nil {
+
+		// it isn't
+		return nil, fmt.Errorf("%s is not a pem file", file)
+
+	}
+
+	// return the data in it
+	return block.Bytes, nil
+
+}
+
+// encrypt data with the slot key. the file is the iv, followed by
+// the data encrypted with aes-128-cbc and padded to the block size.
+// nothing confirms the title reads it like this, it is only known
+// to decrypt back with decryptFromTitle
+func encryptForTitle(key []byte, data []byte) ([]byte, error) {
+
+	// make the cipher
+	block, err := aes.NewCipher(key)
+
+	// handle errors
+	if err != nil {
+
+		// return the error
+		return nil, err
+
+	}
+
+	// pad the data to the block size
+	padding := aes.BlockSize - (len(data) % aes.BlockSize)
+	padded := append(append([]byte{}, data...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	// make room for the iv and the data
+	out := make([]byte, aes.BlockSize+len(padded))
+
+	// generate the iv
+	if _, err := rand.Read(out[:aes.BlockSize]); err != nil {
+
+		// return the error
+		return nil, err
+
+	}
+
+	// encrypt it
+	cipher.NewCBCEncrypter(block, out[:aes.BlockSize]).CryptBlocks(out[aes.BlockSize:], padded)
+
+	// return the encrypted data
+	return out, nil
+
+}
+
+// decrypt data encrypted by encryptForTitle
+func decryptFromTitle(key []byte, data []byte) ([]byte, error) {
+
+	// make sure it is the right size
+	if (len(data) < aes.BlockSize*2) || (len(data)%aes.BlockSize != 0) {
+
+		// it isn't
+		return nil, errors.New("the encrypted data is not a whole number of blocks")
+
+	}
+
+	// make the cipher
+	block, err := aes.NewCipher(key)
+
+	// handle errors
+	if err != nil {
+
+		// return the error
+		return nil, err
+
+	}
+
+	// decrypt it
+	out := make([]byte, len(data)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, data[:aes.BlockSize]).CryptBlocks(out, data[aes.BlockSize:])
+
+	// check the padding
+	padding := int(out[len(out)-1])
+	if (padding == 0) || (padding > aes.BlockSize) || !bytes.Equal(out[len(out)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+
+		// it is wrong
+		return nil, errors.New("the decrypted data has bad padding (is it the right key?)")
+
+	}
+
+	// return the data without the padding
+	return out[:len(out)-padding], nil
+
+}
+
+// read the key for the patch. the cert the title has is rsa, so only
+// rsa keys in pkcs#1 form are written into it
+func readPatchKey(file string, cert *x509.Certificate) ([]byte, error) {
+
+	// decode it
+	block, _ := pem.Decode(readFileByte(file))
+	if block == nil {
+
+		// it isn't pem
+		return nil, fmt.Errorf("%s is not a pem file", file)
+
+	}
+
+	// it has to be pkcs#1
+	if block.Type != "RSA PRIVATE KEY" {
+
+		// it isn't
+		return nil, fmt.Errorf("%s holds a \"%s\", but the patch needs an rsa key in pkcs#1 form (\"RSA PRIVATE KEY\")", file, block.Type)
+
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+
+		// it is wrong
+		return nil, fmt.Errorf("%s couldn't be read as a pkcs#1 rsa key: %s", file, err.Error())
+
+	}
+
+	// and belong to the cert
+	if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok || !keyMatchesCert(key, cert) {
+
+		// it doesn't
+		return nil, fmt.Errorf("%s doesn't belong to the rsa cert in maryo-data", file)
+
+	}
+
+	// return the data in it
+	return block.Bytes, nil
+
+}
+
+// encrypt a file into the patch, and make sure it decrypts back
+func writePatchFile(key []byte, data []byte, file string) {
+
+	// encrypt it
+	encrypted, err := encryptForTitle(key, data)
+
+	// handle errors
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: error while encrypting %s\n", file)
+
+		// show traceback
+		panic(err)
+
+	}
+
+	// write it
+	writeByteToFile(file, encrypted)
+
+	// read it back and decrypt it
+	decrypted, err := decryptFromTitle(key, readFileByte(file))
+
+	// make sure it is the same
+	if (err != nil) || !bytes.Equal(decrypted, data) {
+
+		// it isn't
+		fmt.Printf("[err]: %s didn't decrypt back to what was written...\n", file)
+		if err != nil {
+
+			// show why
+			fmt.Printf("       %s\n", err.Error())
+
+		}
+
+		// exit
+		os.Exit(1)
+
+	}
+
+	// show that it worked
+	fmt.Printf("  %s %s (%d bytes, decrypts back)\n", utilIcons["success"], file, len(encrypted))
+
+}
+
+// patch subcommand
+func patchCommand(args []string) {
+
+	// flags for the patch
+	flags := flag.NewFlagSet("patch", flag.ExitOnError)
+	key := flags.String("key", "maryo-data/0x0D.key", "path of the 0x0D slot key")
+	experimental := flags.Bool("experimental", false, "make the patch even though its format hasn't been checked")
+	flags.Parse(args)
+
+	// nobody knows if the console reads it, so it has to be asked for
+	if !*experimental {
+
+		// show an error message
+		fmt.Printf("[err]: the patch format is maryo's guess, and hasn't been checked against how\n")
+		fmt.Printf("       %s reads its romfs, so the console may not accept it. pass\n", patchTitle)
+		fmt.Printf("       --experimental to make it anyway...\n")
+		os.Exit(1)
+
+	}
+
+	// generate the patch
+	generateRomFSPatch(*key)
+
+}
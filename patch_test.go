@@ -0,0 +1,165 @@
+/*
+
+maryo/patch_test.go
+
+tests for the romfs patch encryption
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"bytes"
+	"crypto/aes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// anything encrypted for the title decrypts back to the same thing
+func TestEncryptForTitle(t *testing.T) {
+
+	// a key
+	key := bytes.Repeat([]byte{0x0d}, aes.BlockSize)
+
+	// data of every size around the block size
+	for _, size := range []int{0, 1, aes.BlockSize - 1, aes.BlockSize, aes.BlockSize + 1, 1000} {
+
+		// encrypt it
+		data := bytes.Repeat([]byte{0xab}, size)
+		encrypted, err := encryptForTitle(key, data)
+		if err != nil {
+
+			// it failed
+			t.Fatalf("%d bytes: error while encrypting: %v", size, err)
+
+		}
+
+		// it is the iv and whole blocks
+		if (len(encrypted) <= size) || (len(encrypted)%aes.BlockSize != 0) {
+
+			// it isn't
+			t.Fatalf("%d bytes: encrypted to %d bytes, which isn't the iv and whole blocks", size, len(encrypted))
+
+		}
+
+		// decrypt it
+		decrypted, err := decryptFromTitle(key, encrypted)
+		if err != nil {
+
+			// it failed
+			t.Fatalf("%d bytes: error while decrypting: %v", size, err)
+
+		}
+		if !bytes.Equal(decrypted, data) {
+
+			// it is different
+			t.Fatalf("%d bytes: didn't decrypt back to what was encrypted", size)
+
+		}
+
+	}
+
+}
+
+// the wrong key doesn't decrypt it
+func TestDecryptFromTitleWrongKey(t *testing.T) {
+
+	// encrypt with one key
+	encrypted, err := encryptForTitle(bytes.Repeat([]byte{1}, aes.BlockSize), []byte("a cert, or a key"))
+	if err != nil {
+
+		// it failed
+		t.Fatalf("error while encrypting: %v", err)
+
+	}
+
+	// and decrypt with another
+	decrypted, err := decryptFromTitle(bytes.Repeat([]byte{2}, aes.BlockSize), encrypted)
+	if (err == nil) && bytes.Equal(decrypted, []byte("a cert, or a key")) {
+
+		// it worked, somehow
+		t.Fatalf("the wrong key decrypted the data")
+
+	}
+
+}
+
+// data that isn't whole blocks can't be decrypted
+func TestDecryptFromTitleShort(t *testing.T) {
+
+	// check each size
+	key := bytes.Repeat([]byte{0x0d}, aes.BlockSize)
+	for _, size := range []int{0, aes.BlockSize, aes.BlockSize*2 + 1} {
+
+		// decrypt it
+		if _, err := decryptFromTitle(key, make([]byte, size)); err == nil {
+
+			// it shouldn't have worked
+			t.Fatalf("%d bytes: decrypted data that isn't the iv and whole blocks", size)
+
+		}
+
+	}
+
+}
+
+// the slot key can be raw or hex, and has to be 16 bytes either way
+func TestReadSlotKey(t *testing.T) {
+
+	// each key file, and if it should be read
+	tests := []struct {
+		name string
+		data string
+		ok   bool
+	}{
+		{"raw", strings.Repeat("k", aes.BlockSize), true},
+		{"hex", strings.Repeat("0d", aes.BlockSize), true},
+		{"hex with a newline", strings.Repeat("0d", aes.BlockSize) + "\n", true},
+		{"empty", "", false},
+		{"one byte", "k", false},
+		{"one byte short", strings.Repeat("k", aes.BlockSize-1), false},
+		{"one byte long", strings.Repeat("k", aes.BlockSize+1), false},
+		{"one hex character short", strings.Repeat("0", aes.BlockSize*2-1), false},
+		{"one hex character long", strings.Repeat("0", aes.BlockSize*2+1), false},
+		{"hex for 15 bytes", strings.Repeat("0d", aes.BlockSize-1), false},
+		{"hex for 17 bytes", strings.Repeat("0d", aes.BlockSize+1), false},
+		{"32 characters that aren't hex", strings.Repeat("zz", aes.BlockSize), false},
+	}
+
+	// check each of them
+	dir := t.TempDir()
+	for _, test := range tests {
+
+		// write it
+		file := filepath.Join(dir, "0x0D.key")
+		if err := os.WriteFile(file, []byte(test.data), 0600); err != nil {
+
+			// it couldn't be written
+			t.Fatalf("%s: error while writing the key: %v", test.name, err)
+
+		}
+
+		// read it
+		key, err := readSlotKey(file)
+		if test.ok && ((err != nil) || (len(key) != aes.BlockSize)) {
+
+			// it should have been read
+			t.Fatalf("%s: the key should have been read, got %d bytes and %v", test.name, len(key), err)
+
+		}
+		if !test.ok && (err == nil) {
+
+			// it shouldn't have been
+			t.Fatalf("%s: the key should have been refused, got %d bytes", test.name, len(key))
+
+		}
+
+	}
+
+}
@@ -0,0 +1,296 @@
+/*
+
+maryo/policy.go
+
+decides what to do with each connection the console
+opens: decrypt it, pass it through, or refuse it
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"fmt"
+	"net"
+	"strings"
+	// externals
+	"github.com/elazarl/goproxy"
+)
+
+// metrics for connection decisions
+var (
+	connectMitm   = newCounter("maryo_connect_mitm_total", "connections that were decrypted")
+	connectTunnel = newCounter("maryo_connect_tunnel_total", "connections that were passed through without decrypting them")
+	connectReject = newCounter("maryo_connect_reject_total", "connections that were refused")
+)
+
+// what to do with connections to each host
+type connectPolicy struct {
+	all       bool
+	endpoints map[string]interface{}
+	mitm      []string
+	block     []string
+	strict    bool
+}
+
+// make the policy from the settings in the config
+func connectPolicyFromConfig(configData map[string]interface{}) *connectPolicy {
+
+	// get the hosts with endpoints, for any console
+	endpoints := make(map[string]interface{})
+	for _, host := range routedHosts(configData) {
+
+		// add it
+		endpoints[host] = true
+
+	}
+
+	// make it
+	return &connectPolicy{
+
+		all:       getSetting(configData, "mitmAll", "false") == "true",
+		endpoints: endpoints,
+		mitm:      getListSetting(configData, "mitmHosts"),
+		block:     getListSetting(configData, "blockHosts"),
+		strict:    getSetting(configData, "strictMode", "false") == "true",
+	}
+
+}
+
+// check if a host matches a pattern. patterns are either a
+// host, or *. followed by a domain to match everything under it
+func hostMatches(pattern string, host string) bool {
+
+	// case doesn't matter
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+
+	// check for a wildcard
+	if strings.HasPrefix(pattern, "*.") {
+
+		// match anything under the domain
+		return strings.HasSuffix(host, pattern[1:])
+
+	}
+
+	// otherwise it has to be the same
+	return pattern == host
+
+}
+
+// check if a host matches any of a list of patterns
+func hostMatchesAny(patterns []string, host string) bool {
+
+	// check each of them
+	for _, pattern := range patterns {
+
+		// check it
+		if hostMatches(pattern, host) {
+
+			// it does
+			return true
+
+		}
+
+	}
+
+	// none of them did
+	return false
+
+}
+
+// find the key in a table of hosts that a host comes under. the host
+// itself is used first, then the longest *. pattern that matches it
+func matchHostKey(keys []string, host string) (string, bool) {
+
+	// case and the port don't matter
+	host = strings.ToLower(stripHostPort(host))
+
+	// check each of them
+	best, found := "", false
+	for _, key := range keys {
+
+		// the host itself wins
+		if strings.ToLower(key) == host {
+
+			// use it
+			return key, true
+
+		}
+
+		// otherwise the longest pattern
+		if hostMatches(key, host) && (!found || (len(key) > len(best))) {
+
+			// use it, unless there's a longer one
+			best, found = key, true
+
+		}
+
+	}
+
+	// return the one that was found, if any
+	return best, found
+
+}
+
+// get the value for a host from a table keyed by hosts and patterns
+func lookupHost(table map[string]interface{}, host string) (interface{}, bool) {
+
+	// get the keys
+	keys := make([]string, 0, len(table))
+	for key := range table {
+
+		// add it
+		keys = append(keys, key)
+
+	}
+
+	// find the one it comes under
+	key, ok := matchHostKey(keys, host)
+	if !ok {
+
+		// there isn't one
+		return nil, false
+
+	}
+	return table[key], true
+
+}
+
+// get the endpoint a host is redirected to in an endpoints table
+func endpointFor(endpoints map[string]interface{}, host string) (string, bool) {
+
+	// look it up
+	value, ok := lookupHost(endpoints, host)
+	target, isString := value.(string)
+	return target, ok && isString
+
+}
+
+// check if connections to a host are refused
+func (policy *connectPolicy) blocked(host string) bool {
+
+	// check the blocklist
+	return hostMatchesAny(policy.block, stripHostPort(host))
+
+}
+
+// check if connections to a host are refused because it has no
+// endpoint, when only endpoints are allowed
+func (policy *connectPolicy) outsideEndpoints(host string) bool {
+
+	// check the endpoints
+	_, ok := lookupHost(policy.endpoints, host)
+	return policy.strict && !ok
+
+}
+
+// decide what to do with a connection, and why
+func (policy *connectPolicy) decide(host string) (*goproxy.ConnectAction, string) {
+
+	// strip the port
+	host = stripHostPort(host)
+
+	// refuse blocked hosts first
+	if policy.blocked(host) {
+
+		// refuse it
+		return goproxy.RejectConnect, "on the blocklist"
+
+	}
+
+	// and hosts without an endpoint in strict mode
+	if policy.outsideEndpoints(host) {
+
+		// refuse it
+		return goproxy.RejectConnect, "no endpoint, and strictMode is on"
+
+	}
+
+	// decrypt hosts that are redirected
+	if _, ok := lookupHost(policy.endpoints, host); ok {
+
+		// decrypt it
+		return goproxy.MitmConnect, "has an endpoint"
+
+	}
+
+	// decrypt hosts on the list
+	if hostMatchesAny(policy.mitm, host) {
+
+		// decrypt it
+		return goproxy.MitmConnect, "in mitmHosts"
+
+	}
+
+	// decrypt everything if asked to
+	if policy.all {
+
+		// decrypt it
+		return goproxy.MitmConnect, "mitmAll is set"
+
+	}
+
+	// pass everything else through
+	return goproxy.OkConnect, "not routed"
+
+}
+
+// handle a connect for goproxy, logging the decision
+func (policy *connectPolicy) handleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+
+	// decide
+	action, reason := policy.decide(host)
+
+	// describe it
+	var what, color string
+	switch action.Action {
+
+	case goproxy.ConnectMitm, goproxy.ConnectHijack:
+
+		// decrypted
+		what, color = "decrypting", "green"
+		connectMitm.add(1)
+
+	case goproxy.ConnectReject:
+
+		// refused
+		what, color = "refusing", "red"
+		connectReject.add(1)
+
+	default:
+
+		// passed through
+		what, color = "tunneling", "grey"
+		connectTunnel.add(1)
+
+	}
+
+	// log it
+	consoleSequence(fmt.Sprintf("-> %s %s%s%s (%s)\n", what, code(color), host, code("reset"), reason))
+	writeLog(fmt.Sprintf("-> %s %s (%s)\n", what, host, reason))
+
+	// return it
+	return action, host
+
+}
+
+// strip the port from a host, if it has one
+func stripHostPort(host string) string {
+
+	// split it
+	if h, _, err := net.SplitHostPort(host); err == nil {
+
+		// use the host
+		return h
+
+	}
+
+	// it didn't have one
+	return host
+
+}
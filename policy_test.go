@@ -0,0 +1,99 @@
+/*
+
+maryo/policy_test.go
+
+tests for matching hosts against patterns
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"testing"
+)
+
+// a pattern is a host, or *. and a domain to match anything under it
+func TestHostMatches(t *testing.T) {
+
+	// each pattern and host, and if they match
+	tests := []struct {
+		pattern string
+		host    string
+		matches bool
+	}{
+		{"account.nintendo.net", "account.nintendo.net", true},
+		{"account.nintendo.net", "ACCOUNT.Nintendo.NET", true},
+		{"Account.Nintendo.net", "account.nintendo.net", true},
+		{"account.nintendo.net", "nintendo.net", false},
+		{"account.nintendo.net", "x.account.nintendo.net", false},
+		{"*.nintendo.net", "account.nintendo.net", true},
+		{"*.nintendo.net", "a.b.nintendo.net", true},
+		{"*.NINTENDO.net", "Account.nintendo.NET", true},
+		{"*.nintendo.net", "nintendo.net", false},
+		{"*.nintendo.net", "notnintendo.net", false},
+		{"*.nintendo.net", "nintendo.net.example.com", false},
+		{"*nintendo.net", "account.nintendo.net", false},
+		{"", "", true},
+		{"", "nintendo.net", false},
+	}
+
+	// check each of them
+	for _, test := range tests {
+
+		// check it
+		if hostMatches(test.pattern, test.host) != test.matches {
+
+			// it is wrong
+			t.Fatalf("hostMatches(%q, %q) should be %v", test.pattern, test.host, test.matches)
+
+		}
+
+	}
+
+}
+
+// the host itself is used first, then the longest pattern, whatever
+// order the keys are in
+func TestMatchHostKey(t *testing.T) {
+
+	// each table, host, and the key it should come under
+	tests := []struct {
+		name  string
+		keys  []string
+		host  string
+		want  string
+		found bool
+	}{
+		{"exact", []string{"account.nintendo.net"}, "account.nintendo.net", "account.nintendo.net", true},
+		{"exact with a port", []string{"account.nintendo.net"}, "account.nintendo.net:443", "account.nintendo.net", true},
+		{"exact in any case", []string{"Account.Nintendo.net"}, "ACCOUNT.nintendo.net", "Account.Nintendo.net", true},
+		{"exact before a pattern", []string{"*.nintendo.net", "account.nintendo.net"}, "account.nintendo.net", "account.nintendo.net", true},
+		{"exact after a pattern", []string{"account.nintendo.net", "*.nintendo.net"}, "account.nintendo.net", "account.nintendo.net", true},
+		{"pattern", []string{"*.nintendo.net"}, "conntest.nintendo.net:80", "*.nintendo.net", true},
+		{"longest pattern first", []string{"*.account.nintendo.net", "*.nintendo.net"}, "a.account.nintendo.net", "*.account.nintendo.net", true},
+		{"longest pattern last", []string{"*.nintendo.net", "*.account.nintendo.net"}, "a.account.nintendo.net", "*.account.nintendo.net", true},
+		{"shorter pattern", []string{"*.nintendo.net", "*.account.nintendo.net"}, "conntest.nintendo.net", "*.nintendo.net", true},
+		{"a pattern doesn't match the domain", []string{"*.nintendo.net"}, "nintendo.net", "", false},
+		{"nothing matches", []string{"account.nintendo.net", "*.pretendo.cc"}, "nintendo.net", "", false},
+		{"no keys", []string{}, "nintendo.net", "", false},
+	}
+
+	// check each of them
+	for _, test := range tests {
+
+		// check it
+		key, found := matchHostKey(test.keys, test.host)
+		if (key != test.want) || (found != test.found) {
+
+			// it is wrong
+			t.Fatalf("%s: expected %q and %v, got %q and %v", test.name, test.want, test.found, key, found)
+
+		}
+
+	}
+
+}
@@ -16,7 +16,9 @@ import (
 	// internals
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 	"net/http/httputil"
@@ -28,7 +30,7 @@ import (
 // set this over here for no issues
 var config map[string]interface{}
 
-func startProxy(configName string, logging bool) {
+func startProxy(configName string, logging bool, connectInfo bool) {
 
 	// set the terminal title
 	ttitle("maryo -> proxy")
@@ -39,124 +41,313 @@ func startProxy(configName string, logging bool) {
 	// check if we decrypt all connections
 	decryptAll := config["config"].(map[string]interface{})["decryptOutgoing"].(string)
 
-	// check if log file exists
-	if doesFileExist("maryo-data/proxy.log") == false {
+	// open the log, adding to it, and close it when the proxy stops
+	if err := currentLog.open(proxyLogPath); err != nil {
 
-		// make it then
-		createFile("maryo-data/proxy.log")
+		// show an error message
+		fmt.Printf("[err]: error while opening %s: %s\n", proxyLogPath, err.Error())
+		os.Exit(1)
 
 	}
+	currentSession.onShutdown(func() { currentLog.Close() })
 
 	// write current timestamp to log
 	t := time.Now().Format("20060102150405")
-	writeFile("maryo-data/proxy.log", fmt.Sprintf("-> started log [%s]\n", t))
+	writeLog(fmt.Sprintf("-> started log [%s]\n", t))
 
 	// get ip
-	ip := getIP()
+	ip := getIP(getSetting(config, "interface", ""))
 
 	// start the console log
 	fmt.Printf("-- proxy log --\n")
 	consoleSequence(fmt.Sprintf("-> local IP address is %s%s%s\n", code("green"), ip, code("reset")))
-	consoleSequence(fmt.Sprintf("-> hosting proxy on %s:9437%s\n", code("green"), code("reset")))
-	writeFile("maryo-data/proxy.log", fmt.Sprintf("-> got local ip as %s, hosting on port :9437", ip))
+
+	// show the other addresses the proxy can be reached on
+	addresses, _ := listAddresses()
+	for _, addr := range addresses {
+
+		// skip the one we already showed
+		if addr.ip.String() != ip {
+
+			// show it
+			consoleSequence(fmt.Sprintf("-> also reachable on %s%s%s\n", code("grey"), addr.String(), code("reset")))
+
+		}
+
+	}
+	consoleSequence(fmt.Sprintf("-> hosting proxy on %s:%s%s\n", code("green"), proxyPort, code("reset")))
+	writeLog(fmt.Sprintf("-> got local ip as %s, hosting on port :%s", ip, proxyPort))
+
+	// show how to connect the console
+	if (connectInfo == true) || (getSetting(config, "showConnectInfo", "false") == "true") {
+
+		// show it
+		printConnectInfo(ip, getSetting(config, "proxyUser", ""))
+
+	}
 
 	// load that proxy
 	proxy := goproxy.NewProxyHttpServer()
 
+	// decide who can use the proxy
+	access, err := accessControlFromConfig(config)
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: %s\n", err.Error())
+		os.Exit(1)
+
+	}
+	access.describe()
+
+	// tell the consoles apart
+	consoles, err := consolesFromConfig(config)
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: %s\n", err.Error())
+		os.Exit(1)
+
+	}
+
+	// show the connection info to anything that visits the proxy directly
+	infoMux := newInfoMux(ip, access)
+	handlePAC(infoMux, configName, config, ip, access)
+	infoMux.Handle("/consoles", access.protect(http.HandlerFunc(consoles.serveConsoles)))
+	proxy.NonproxyHandler = infoMux
+
 	// set some settings
 
-	// http client for use when performing POST requests
-	httpClient := &http.Client{}
+	// load the ninty cert and key for decrypting
+	ca, err := loadProxyCA(config)
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: error while loading the proxy CA\n")
+
+		// show traceback
+		panic(err)
+
+	}
+
+	// sign certificates through the cache, and add it to the proxy
+	leafCache := leafCacheFromConfig(config, &ca)
+	setCA(leafCache)
+	newGaugeFunc("maryo_leaf_cache_entries", "leaf certificates kept in memory", leafCache.length)
+
+	// keep an eye on when the certificates expire
+	go certMonitorFromConfig(config, leafCache).run()
+
+	// write the tls keys if asked to
+	if keyLogPath := getSetting(config, "keyLogFile", os.Getenv("SSLKEYLOGFILE")); keyLogPath != "" {
+
+		// open the key log
+		keys, err := openKeyLog(keyLogPath)
+		if err != nil {
+
+			// show an error message
+			fmt.Printf("[err]: error while opening the key log %s\n", keyLogPath)
+
+			// show traceback
+			panic(err)
+
+		}
+
+		// make sure the user knows
+		warnKeyLog(keyLogPath)
+		writeLog(fmt.Sprintf("-> writing tls keys to %s\n", keyLogPath))
+
+		// the console side of decrypted connections
+		leafCache.keyLog = keys
+		currentSession.onShutdown(func() { keys.Close() })
+
+		// and the server side of them
+		proxy.Tr.TLSClientConfig = proxy.Tr.TLSClientConfig.Clone()
+		proxy.Tr.TLSClientConfig.KeyLogWriter = keys
+
+	}
+
+	// set up the connections to each endpoint
+	upstream, err := upstreamsFromConfig(config, proxy.Tr)
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: %s\n", err.Error())
+		os.Exit(1)
+
+	}
+	proxy.Tr = upstream.base
+
+	// and the connections that are passed through
+	connectDial, err := connectDialFromConfig(config, proxy)
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: upstreamProxy is wrong: %s\n", err.Error())
+		os.Exit(1)
+
+	}
+	if connectDial != nil {
+
+		// use it
+		proxy.ConnectDial = connectDial
+
+	}
+
+	// sign certificates for the redirected hosts ahead of time
+	hosts := routedHosts(config)
+	go func() {
+
+		// sign them
+		count := leafCache.pregenerate(hosts)
+		consoleSequence(fmt.Sprintf("-> pre-generated %s%d%s certificate(s)\n", code("green"), count, code("reset")))
+		writeLog(fmt.Sprintf("-> pre-generated %d certificate(s)\n", count))
 
-	// add the ninty cert and key to the proxy for decrypting
-	setCA(nintyCert, nintyKey)
+	}()
 
 	// verbose mode can be a little... too verbose
 	proxy.Verbose = logging
 
 	// set up the proxy
 
-	// make it always MITM
-	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	// only decrypt the connections we need to
+	policy := connectPolicyFromConfig(config)
+	proxy.OnRequest().HandleConnectFunc(policy.handleConnect)
 
-	// request handler
-	proxy.OnRequest().DoFunc(
-		func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	// block, log, and redirect a request. it gives a response
+	// if the request shouldn't be sent
+	route := func(r *http.Request) *http.Response {
 
-			// log the request
-			consoleSequence(fmt.Sprintf("-> request to %s%s%s\n", code("green"), r.URL.Host, code("reset")))
-			writeFile("maryo-data/proxy.log", fmt.Sprintf("-> got request to %s\n", r.URL.Host))
+		// count it, and find out which console sent it
+		currentSession.request(r.URL.Host)
+		console, overrides := consoles.identify(r)
 
-			// get prettified request
+		// refuse blocked hosts
+		if policy.blocked(r.URL.Host) {
 
-			// define these variables so no errors
-			var reqData []byte
-			var err error
+			// let the user know
+			consoleSequence(fmt.Sprintf("-> refusing %s%s%s (on the blocklist)\n", code("red"), r.URL.Host, code("reset")))
+			writeLog(fmt.Sprintf("-> refusing %s (on the blocklist)\n", r.URL.Host))
+			connectReject.add(1)
+			return goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusForbidden, "this host is blocked by maryo\n")
 
-			// no errors for post requests
-			if r.Method == "POST" {
+		}
 
-				// if it is, then tell the dumper it is
-				reqData, err = httputil.DumpRequest(r, true)
+		// and hosts without an endpoint in strict mode
+		if policy.outsideEndpoints(r.URL.Host) {
 
-			} else {
+			// let the user know
+			consoleSequence(fmt.Sprintf("-> refusing %s%s%s (no endpoint, and strictMode is on)\n", code("red"), r.URL.Host, code("reset")))
+			writeLog(fmt.Sprintf("-> refusing %s (no endpoint, and strictMode is on)\n", r.URL.Host))
+			connectReject.add(1)
+			return goproxy.NewResponse(r, goproxy.ContentTypeText, http.StatusForbidden, "maryo only proxies the hosts in its endpoints\n")
 
-				// otherwise, don't
-				reqData, err = httputil.DumpRequest(r, false)
+		}
 
-			}
+		// log the request
+		consoleSequence(fmt.Sprintf("-> request to %s%s%s from %s\n", code("green"), r.URL.Host, code("reset"), console))
+		writeLog(fmt.Sprintf("-> got request to %s from %s\n", r.URL.Host, console))
 
-			if err != nil {
+		// get prettified request
 
-				// output error
-				fmt.Printf("[err]: error occurred while dumping http request\n")
-				fmt.Printf("%s\n", err.Error())
+		// define these variables so no errors
+		var reqData []byte
+		var err error
 
-			}
+		// no errors for post requests
+		if r.Method == "POST" {
 
-			// if it is said to be verbose with logging, print request data
-			if logging == true {
+			// if it is, then tell the dumper it is
+			reqData, err = httputil.DumpRequest(r, true)
 
-				// log the request data, then
-				fmt.Printf("\n-- request data\n")
-				fmt.Printf("%s", string(reqData[:]))
-				fmt.Printf("\n\n")
+		} else {
 
-			}
+			// otherwise, don't
+			reqData, err = httputil.DumpRequest(r, false)
+
+		}
+
+		if err != nil {
+
+			// output error
+			fmt.Printf("[err]: error occurred while dumping http request\n")
+			fmt.Printf("%s\n", err.Error())
 
-			// always log to file
-			writeFile("maryo-data/proxy.log", fmt.Sprintf("-> request data to %s\n", r.URL.Host))
-			writeFile("maryo-data/proxy.log", fmt.Sprintf("%s", string(reqData[:])))
-			writeFile("maryo-data/proxy.log", fmt.Sprintf("\n\n"))
+		}
 
-			// attempt to proxy it to the servers listed in config
+		// if it is said to be verbose with logging, print request data
+		if logging == true {
 
-			// check if it is in it in the first place
-			// also, strip the URL of the port
-			if redirTo, isItIn := config["endpoints"].(map[string]interface{})[strings.Split(r.URL.Host, ":")[0]].(string); isItIn {
+			// log the request data, then
+			fmt.Printf("\n-- request data\n")
+			fmt.Printf("%s", string(reqData[:]))
+			fmt.Printf("\n\n")
 
-				// check if we decrypt all outgoing connections
-				if decryptAll == "true" {
+		}
 
-					// if protocol is HTTPS
-					if r.URL.Scheme == "https" {
+		// always log to file
+		writeLog(fmt.Sprintf("-> request data to %s\n", r.URL.Host))
+		writeLog(fmt.Sprintf("%s", string(reqData[:])))
+		writeLog(fmt.Sprintf("\n\n"))
 
-						// let the user know
-						fmt.Printf("-> switching protocol to http\n")
+		// attempt to proxy it to the servers listed in config
 
-						// set it to HTTP
-						r.URL.Scheme = "http"
+		// check if it is in it in the first place, using the console's
+		// own endpoints before everyone's
+		// also, strip the URL of the port
+		redirTo, isItIn := endpointFor(overrides, r.URL.Host)
+		if !isItIn {
 
-					}
+			// use everyone's
+			redirTo, isItIn = endpointFor(config["endpoints"].(map[string]interface{}), r.URL.Host)
+
+		}
+		if isItIn {
+
+			// check if we decrypt outgoing connections to this endpoint,
+			// which it can set for itself in endpointConfig
+			if getEndpointSetting(config, strings.Split(r.URL.Host, ":")[0], "decryptOutgoing", decryptAll) == "true" {
+
+				// if protocol is HTTPS
+				if r.URL.Scheme == "https" {
+
+					// let the user know
+					fmt.Printf("-> switching protocol to http\n")
+
+					// set it to HTTP
+					r.URL.Scheme = "http"
 
 				}
 
-				// log the redirect
-				consoleSequence(fmt.Sprintf("-> proxying %s%s%s to %s%s%s\n", code("green"), r.URL.Host, code("reset"), code("green"), redirTo, code("reset")))
-				writeFile("maryo-data/proxy.log", fmt.Sprintf("-> proxying %s to %s", r.URL.Host, redirTo))
+			}
+
+			// log the redirect
+			consoleSequence(fmt.Sprintf("-> proxying %s%s%s to %s%s%s for %s\n", code("green"), r.URL.Host, code("reset"), code("green"), redirTo, code("reset"), console))
+			writeLog(fmt.Sprintf("-> proxying %s to %s for %s", r.URL.Host, redirTo, console))
+
+			// redirect it
+			r.URL.Host = redirTo
+
+		}
+
+		// send it
+		return nil
+
+	}
+
+	// request handler
+	proxy.OnRequest().DoFunc(
+		func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+
+			// send it with the settings for the host the console asked for
+			host := r.URL.Host
+			ctx.RoundTripper = upstream.roundTripper(host)
 
-				// redirect it
-				r.URL.Host = redirTo
+			// block, log, and redirect it
+			if resp := route(r); resp != nil {
+
+				// it was blocked
+				return r, resp
 
 			}
 
@@ -170,15 +361,16 @@ func startProxy(configName string, logging bool) {
 				newReq := cloneReq(r)
 
 				// perform the request
-				resp, err := httpClient.Do(newReq)
+				resp, err := upstream.send(host, newReq)
 
 				// error handling
 				if err != nil {
 
 					// return a response
-					return r, goproxy.NewResponse(newReq, goproxy.ContentTypeText, http.StatusBadGateway, strings.Join([]string{"no worries, this is an error in maryo\n", err.Error()}, ""))
+					return r, upstreamErrorResponse(newReq, err)
 
 				}
+				logProtocols(host, r.Proto, resp.Proto)
 
 				// dump response
 
@@ -227,7 +419,48 @@ func startProxy(configName string, logging bool) {
 
 		})
 
-	// start the proxy
-	log.Fatal(http.ListenAndServe(":9437", proxy))
+	// pass upgraded connections through, and decrypt connections
+	// so that the requests in them can be upgraded
+	// and keep clients from going over their rate limit
+	handler := access.limit(upgradeHandlerFromConfig(config, proxy, route, upstream))
+	useMitm(handler, leafCache, upstream)
+
+	// accept socks5 too if asked to
+	startSOCKS(config, handler, policy, access)
+
+	// answer dns for the endpoints, and take the connections that brings
+	if dnsMode || (getSetting(config, "dnsMode", "false") == "true") {
+
+		// start them
+		startDNS(config, ip, access, consoles)
+		startTransparent(config, handler, access)
+
+	// or just take connections sent here some other way
+	} else if getSetting(config, "transparentMode", "false") == "true" {
+
+		// start them
+		startTransparent(config, handler, access)
+
+	}
+
+	// start the proxy, only for allowed clients that logged in
+	server := &http.Server{Addr: strings.Join([]string{":", proxyPort}, ""), Handler: access.authenticate(handler), IdleTimeout: idleTimeout}
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+
+		// it couldn't start
+		log.Fatal(err)
+
+	}
+	stopped := shutdownOnSignal(server, config)
+	if err := server.Serve(access.listener(listener)); err != http.ErrServerClosed {
+
+		// it couldn't start
+		log.Fatal(err)
+
+	}
+
+	// wait for it to finish stopping
+	<-stopped
 
 }
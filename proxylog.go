@@ -0,0 +1,111 @@
+/*
+
+maryo/proxylog.go
+
+the proxy log, opened once when the proxy starts and
+written to by everything that handles a connection
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"fmt"
+	"os"
+	"sync"
+)
+
+// where the proxy log is kept
+const proxyLogPath = "maryo-data/proxy.log"
+
+// a log that can be written to by many connections at once
+type proxyLog struct {
+	lock   sync.Mutex
+	file   *os.File
+	failed bool
+}
+
+// the log of the running proxy
+var currentLog = &proxyLog{}
+
+// open the log, adding to it if it already exists
+func (log *proxyLog) open(path string) error {
+
+	// open it
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+
+		// return the error
+		return err
+
+	}
+
+	// use it
+	log.lock.Lock()
+	log.file = file
+	log.failed = false
+	log.lock.Unlock()
+	return nil
+
+}
+
+// write to the log, if it is open
+func (log *proxyLog) write(data string) {
+
+	// one connection at a time
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	// it might not be open, or already closed
+	if log.file == nil {
+
+		// it isn't
+		return
+
+	}
+
+	// write it
+	if _, err := log.file.WriteString(data); (err != nil) && !log.failed {
+
+		// only say so once, and keep the proxy going
+		log.failed = true
+		fmt.Printf("[err]: error while writing to the proxy log: %s\n", err.Error())
+
+	}
+
+}
+
+// close the log, making sure everything is written
+func (log *proxyLog) Close() error {
+
+	// wait for any writes
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	// it might not be open
+	if log.file == nil {
+
+		// it isn't
+		return nil
+
+	}
+
+	// write it out and close it
+	log.file.Sync()
+	err := log.file.Close()
+	log.file = nil
+	return err
+
+}
+
+// write to the proxy log
+func writeLog(data string) {
+
+	// write it
+	currentLog.write(data)
+
+}
@@ -0,0 +1,640 @@
+/*
+
+maryo/resilience.go
+
+keeps a slow or broken server from leaving the console waiting
+forever, with timeouts, retries, and a circuit breaker
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	// externals
+	"github.com/elazarl/goproxy"
+)
+
+// metrics for upstream calls
+var (
+	upstreamRetries   = newCounter("maryo_upstream_retries_total", "upstream requests that were tried again")
+	upstreamFailures  = newCounter("maryo_upstream_failures_total", "upstream requests that failed or timed out")
+	breakerFastFails  = newCounter("maryo_breaker_fast_fails_total", "requests failed right away because their server kept failing")
+	breakerOpenings   = newCounter("maryo_breaker_openings_total", "times a server failed enough to stop sending it requests")
+	idempotentMethods = []string{"GET", "HEAD", "OPTIONS", "PUT", "DELETE", "TRACE"}
+)
+
+// how requests to an endpoint are sent
+type callPolicy struct {
+	connectTimeout time.Duration
+	tlsTimeout     time.Duration
+	headerTimeout  time.Duration
+	totalTimeout   time.Duration
+	retries        int
+	backoff        time.Duration
+	threshold      int
+	cooldown       time.Duration
+}
+
+// the settings for a call policy, with their defaults
+var callPolicySettings = [][2]string{
+	{"connectTimeout", "10s"},
+	{"tlsTimeout", "10s"},
+	{"headerTimeout", "30s"},
+	{"requestTimeout", "0"},
+	{"retries", "2"},
+	{"retryBackoff", "250ms"},
+	{"breakerThreshold", "5"},
+	{"breakerCooldown", "30s"},
+}
+
+// make a call policy, getting each setting with get
+func callPolicyFrom(get func(name string, def string) string) (*callPolicy, error) {
+
+	// get the durations
+	durations := make(map[string]time.Duration)
+	for _, setting := range callPolicySettings {
+
+		// the counts aren't durations
+		if (setting[0] == "retries") || (setting[0] == "breakerThreshold") {
+
+			// skip them
+			continue
+
+		}
+
+		// parse it
+		value, err := time.ParseDuration(get(setting[0], setting[1]))
+		if (err != nil) || (value < 0) {
+
+			// it is wrong
+			return nil, fmt.Errorf("%s must be a duration like 500ms or 10s", setting[0])
+
+		}
+		durations[setting[0]] = value
+
+	}
+
+	// get the counts
+	retries, err := strconv.Atoi(get("retries", "2"))
+	if (err != nil) || (retries < 0) {
+
+		// it is wrong
+		return nil, errors.New("retries must be a number, 0 or more")
+
+	}
+	threshold, err := strconv.Atoi(get("breakerThreshold", "5"))
+	if (err != nil) || (threshold < 0) {
+
+		// it is wrong
+		return nil, errors.New("breakerThreshold must be a number, 0 or more (0 turns it off)")
+
+	}
+
+	// make it
+	return &callPolicy{
+
+		connectTimeout: durations["connectTimeout"],
+		tlsTimeout:     durations["tlsTimeout"],
+		headerTimeout:  durations["headerTimeout"],
+		totalTimeout:   durations["requestTimeout"],
+		retries:        retries,
+		backoff:        durations["retryBackoff"],
+		threshold:      threshold,
+		cooldown:       durations["breakerCooldown"],
+	}, nil
+
+}
+
+// set the timeouts on a transport
+func (policy *callPolicy) apply(transport *http.Transport) {
+
+	// time out connecting
+	dialer := &net.Dialer{Timeout: policy.connectTimeout, KeepAlive: 30 * time.Second}
+	transport.DialContext = dialer.DialContext
+
+	// and the rest
+	transport.TLSHandshakeTimeout = policy.tlsTimeout
+	transport.ResponseHeaderTimeout = policy.headerTimeout
+
+}
+
+// check if the settings for an endpoint change anything
+func endpointChangesCallPolicy(configData map[string]interface{}, host string) bool {
+
+	// check each setting
+	for _, setting := range callPolicySettings {
+
+		// check it
+		if getEndpointSetting(configData, host, setting[0], "") != "" {
+
+			// it does
+			return true
+
+		}
+
+	}
+
+	// it doesn't
+	return false
+
+}
+
+// set up the timeouts, retries, and breakers from the config
+func (u *upstreams) applyCallPolicies(configData map[string]interface{}) error {
+
+	// get the policy for everything
+	base, err := callPolicyFrom(func(name string, def string) string {
+
+		// from the config section
+		return getSetting(configData, name, def)
+
+	})
+	if err != nil {
+
+		// return the error
+		return err
+
+	}
+	u.basePolicy = base
+	u.policies = make(map[string]*callPolicy)
+	u.breakers = make(map[string]*breaker)
+	base.apply(u.base)
+	for _, transport := range u.endpoints {
+
+		// and the endpoints that have their own transport
+		base.apply(transport)
+
+	}
+
+	// get the policy for each endpoint that changes it
+	for _, host := range endpointConfigHosts(configData) {
+
+		// skip it if it doesn't
+		if !endpointChangesCallPolicy(configData, host) {
+
+			// it uses the policy for everything
+			continue
+
+		}
+
+		// get it, with anything it doesn't set from everything's
+		policy, err := callPolicyFrom(func(name string, def string) string {
+
+			// from the endpoint, then the config section
+			return getEndpointSetting(configData, host, name, getSetting(configData, name, def))
+
+		})
+		if err != nil {
+
+			// return the error
+			return fmt.Errorf("the timeouts for %s are wrong: %s", host, err.Error())
+
+		}
+		u.policies[host] = policy
+
+		// make sure it has its own transport
+		transport, ok := u.endpoints[host]
+		if !ok {
+
+			// copy the base
+			transport = copyTransport(u.base)
+			u.endpoints[host] = transport
+
+		}
+
+		// set it
+		policy.apply(transport)
+
+	}
+
+	// show how many servers are being skipped
+	newGaugeFunc("maryo_breakers_open", "servers that requests aren't being sent to because they kept failing", func() float64 {
+
+		// count them
+		return float64(u.openBreakers())
+
+	})
+
+	// no errors
+	return nil
+
+}
+
+// get the policy for a host
+func (u *upstreams) policy(host string) *callPolicy {
+
+	// check for one for the endpoint
+	if policy, ok := u.policies[u.configKey(host)]; ok {
+
+		// use it
+		return policy
+
+	}
+
+	// use the base
+	return u.basePolicy
+
+}
+
+// the state of the breaker for one host
+type breaker struct {
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+	trying    bool
+}
+
+// an error for requests that weren't sent because the breaker is open
+type breakerOpenError struct {
+	host     string
+	failures int
+	wait     time.Duration
+}
+
+// describe it
+func (err *breakerOpenError) Error() string {
+
+	// one request is already checking if it is back
+	if err.wait == 0 {
+
+		// say so
+		return fmt.Sprintf("%s failed %d times in a row, and maryo is checking if it is back", err.host, err.failures)
+
+	}
+
+	// describe it
+	return fmt.Sprintf("%s failed %d times in a row, so maryo won't send it requests for another %s", err.host, err.failures, err.wait.Round(time.Second))
+
+}
+
+// get the breaker for a host
+func (u *upstreams) breaker(host string) *breaker {
+
+	// only one at a time
+	u.breakerLock.Lock()
+	defer u.breakerLock.Unlock()
+
+	// make it if there isn't one
+	host = stripHostPort(host)
+	b, ok := u.breakers[host]
+	if !ok {
+
+		// make it
+		b = &breaker{}
+		u.breakers[host] = b
+
+	}
+
+	// return it
+	return b
+
+}
+
+// count the breakers that are open
+func (u *upstreams) openBreakers() int {
+
+	// only one at a time
+	u.breakerLock.Lock()
+	defer u.breakerLock.Unlock()
+
+	// count them
+	count := 0
+	now := time.Now()
+	for _, b := range u.breakers {
+
+		// check it
+		b.lock.Lock()
+		if now.Before(b.openUntil) {
+
+			// it is open
+			count++
+
+		}
+		b.lock.Unlock()
+
+	}
+
+	// return the count
+	return count
+
+}
+
+// check if a request can be sent. once the cooldown is over, one
+// request is let through to see if the server is back
+func (b *breaker) allow(host string, policy *callPolicy) error {
+
+	// only one at a time
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// it is closed if it is off or there haven't been enough failures
+	if (policy.threshold == 0) || (b.failures < policy.threshold) {
+
+		// send it
+		return nil
+
+	}
+
+	// it is open until the cooldown is over
+	if wait := time.Until(b.openUntil); wait > 0 {
+
+		// don't send it
+		return &breakerOpenError{host: host, failures: b.failures, wait: wait}
+
+	}
+
+	// then one request tries it
+	if b.trying {
+
+		// don't send the others
+		return &breakerOpenError{host: host, failures: b.failures, wait: 0}
+
+	}
+	b.trying = true
+	return nil
+
+}
+
+// record how a request went
+func (b *breaker) record(host string, policy *callPolicy, ok bool) {
+
+	// only one at a time
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// it is done trying
+	b.trying = false
+
+	// it worked
+	if ok {
+
+		// let the user know if it was open
+		if (policy.threshold != 0) && (b.failures >= policy.threshold) {
+
+			// let them know
+			consoleSequence(fmt.Sprintf("-> %s%s%s is answering again\n", code("green"), host, code("reset")))
+			writeLog(fmt.Sprintf("-> %s is answering again\n", host))
+
+		}
+		b.failures = 0
+		return
+
+	}
+
+	// it didn't
+	b.failures++
+	if (policy.threshold != 0) && (b.failures >= policy.threshold) {
+
+		// stop sending it requests for a while
+		b.openUntil = time.Now().Add(policy.cooldown)
+		breakerOpenings.add(1)
+		consoleSequence(fmt.Sprintf("-> %s%s failed %d times in a row, failing requests to it right away for %s%s\n", code("red"), host, b.failures, policy.cooldown, code("reset")))
+		writeLog(fmt.Sprintf("-> %s failed %d times in a row, failing requests to it right away for %s\n", host, b.failures, policy.cooldown))
+
+	}
+
+}
+
+// a response body that cancels the request's context when closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// close it, and cancel the context
+func (body *cancelBody) Close() error {
+
+	// close it
+	err := body.ReadCloser.Close()
+	body.cancel()
+
+	// return the error
+	return err
+
+}
+
+// check if a request can be sent again safely
+func canRetry(req *http.Request) bool {
+
+	// it can't have a body that was already read
+	if (req.Body != nil) && (req.Body != http.NoBody) && (req.GetBody == nil) {
+
+		// it does
+		return false
+
+	}
+
+	// and sending it twice can't change anything
+	for _, method := range idempotentMethods {
+
+		// check it
+		if req.Method == method {
+
+			// it can
+			return true
+
+		}
+
+	}
+
+	// it can't
+	return false
+
+}
+
+// check if a response means the server is having trouble
+func serverTrouble(resp *http.Response) bool {
+
+	// gateway errors mean it is
+	return (resp.StatusCode == http.StatusBadGateway) || (resp.StatusCode == http.StatusServiceUnavailable) || (resp.StatusCode == http.StatusGatewayTimeout)
+
+}
+
+// send a request for a host, with its timeouts, retries, and breaker
+func (u *upstreams) send(host string, req *http.Request) (*http.Response, error) {
+
+	// use the host's transport
+	return u.sendWith(host, u.transport(host), req)
+
+}
+
+// send a request for a host with a transport
+func (u *upstreams) sendWith(host string, transport *http.Transport, req *http.Request) (*http.Response, error) {
+
+	// fail right away if the server keeps failing
+	policy := u.policy(host)
+	b := u.breaker(host)
+	if err := b.allow(stripHostPort(host), policy); err != nil {
+
+		// fail it
+		breakerFastFails.add(1)
+		return nil, err
+
+	}
+
+	// get how many times it can be sent
+	attempts := 1
+	if canRetry(req) {
+
+		// it can be tried again
+		attempts += policy.retries
+
+	}
+
+	// send it
+	backoff := policy.backoff
+	for attempt := 1; ; attempt++ {
+
+		// use a fresh copy after the first try
+		try := req
+		if attempt > 1 {
+
+			// copy it
+			try = req.Clone(req.Context())
+			if req.GetBody != nil {
+
+				// with a fresh body
+				try.Body, _ = req.GetBody()
+
+			}
+
+		}
+
+		// limit how long it can take, except for upgrades, which stay open
+		var cancel context.CancelFunc
+		if (policy.totalTimeout > 0) && !isUpgrade(req) {
+
+			// limit it
+			var ctx context.Context
+			ctx, cancel = context.WithTimeout(req.Context(), policy.totalTimeout)
+			try = try.WithContext(ctx)
+
+		}
+
+		// send it
+		setHostForProxy(transport, try)
+		resp, err := transport.RoundTrip(try)
+		failed := (err != nil) || serverTrouble(resp)
+
+		// stop if it worked, or it can't be tried again
+		if !failed || (attempt >= attempts) {
+
+			// record it
+			b.record(stripHostPort(host), policy, !failed)
+			if failed {
+
+				// count it
+				upstreamFailures.add(1)
+
+			}
+			if err != nil {
+
+				// return the error
+				if cancel != nil {
+
+					// let go of the context
+					cancel()
+
+				}
+				return nil, err
+
+			}
+
+			// the context lasts until the body is read
+			if cancel != nil {
+
+				// cancel it when the body is closed
+				resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+
+			}
+			return resp, nil
+
+		}
+
+		// get ready to try again
+		reason := ""
+		if err != nil {
+
+			// it failed
+			reason = err.Error()
+
+		} else {
+
+			// the server had trouble
+			reason = resp.Status
+			resp.Body.Close()
+
+		}
+		if cancel != nil {
+
+			// let go of the context
+			cancel()
+
+		}
+
+		// let the user know
+		upstreamRetries.add(1)
+		consoleSequence(fmt.Sprintf("-> trying %s%s%s again in %s (%d of %d): %s\n", code("yellow"), req.URL.Host, code("reset"), backoff, attempt+1, attempts, reason))
+		writeLog(fmt.Sprintf("-> trying %s again in %s (%d of %d): %s\n", req.URL.Host, backoff, attempt+1, attempts, reason))
+
+		// wait a bit longer each time, unless the console gives up first
+		select {
+
+		case <-time.After(backoff):
+
+		case <-req.Context().Done():
+
+			// it did, so record the failure, which also lets the
+			// next request try the server if this one was trying it
+			b.record(stripHostPort(host), policy, false)
+			upstreamFailures.add(1)
+			return nil, req.Context().Err()
+
+		}
+		backoff *= 2
+
+	}
+
+}
+
+// make the response sent to the console when a request couldn't be sent
+func upstreamErrorResponse(req *http.Request, err error) *http.Response {
+
+	// the breaker is open
+	var open *breakerOpenError
+	if errors.As(err, &open) {
+
+		// tell the console to try later
+		resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusServiceUnavailable, strings.Join([]string{"no worries, this is an error in maryo\n", err.Error(), "\n"}, ""))
+		resp.Header.Set("Retry-After", strconv.Itoa(int(open.wait.Seconds())+1))
+		return resp
+
+	}
+
+	// it timed out
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+
+		// say so
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusGatewayTimeout, strings.Join([]string{"no worries, this is an error in maryo\nthe server took too long to answer: ", err.Error(), "\n"}, ""))
+
+	}
+
+	// it failed some other way
+	return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, strings.Join([]string{"no worries, this is an error in maryo\n", err.Error(), "\n"}, ""))
+
+}
@@ -0,0 +1,244 @@
+/*
+
+maryo/resilience_test.go
+
+tests for the call policies and the breaker
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// make upstreams that only use a policy, without a config
+func testUpstreams(policy *callPolicy) *upstreams {
+
+	// make them
+	return &upstreams{
+
+		base:       &http.Transport{},
+		endpoints:  make(map[string]*http.Transport),
+		basePolicy: policy,
+		policies:   make(map[string]*callPolicy),
+		breakers:   make(map[string]*breaker),
+		http1:      make(map[*http.Transport]*http.Transport),
+	}
+
+}
+
+// the breaker opens after enough failures, lets one request try the
+// server once the cooldown is over, and closes when it works
+func TestBreaker(t *testing.T) {
+
+	// each step, and what allow should say after it
+	policy := &callPolicy{threshold: 2, cooldown: time.Hour}
+	steps := []struct {
+		name    string
+		do      func(b *breaker)
+		allowed bool
+	}{
+		{"new", func(b *breaker) {}, true},
+		{"one failure", func(b *breaker) { b.record("host", policy, false) }, true},
+		{"two failures", func(b *breaker) { b.record("host", policy, false) }, false},
+		{"cooldown over", func(b *breaker) { b.openUntil = time.Now().Add(-time.Second) }, true},
+		{"trying", func(b *breaker) {}, false},
+		{"trial worked", func(b *breaker) { b.record("host", policy, true) }, true},
+		{"still closed", func(b *breaker) {}, true},
+	}
+
+	// run them in order
+	b := &breaker{}
+	for _, step := range steps {
+
+		// check it
+		step.do(b)
+		if err := b.allow("host", policy); (err == nil) != step.allowed {
+
+			// it is wrong
+			t.Fatalf("%s: allowed should be %v, got error %v", step.name, step.allowed, err)
+
+		}
+
+	}
+
+}
+
+// a threshold of 0 turns the breaker off
+func TestBreakerOff(t *testing.T) {
+
+	// fail it a lot
+	policy := &callPolicy{threshold: 0, cooldown: time.Hour}
+	b := &breaker{}
+	for x := 0; x < 10; x++ {
+
+		// fail it
+		b.record("host", policy, false)
+
+	}
+
+	// it should still send requests
+	if err := b.allow("host", policy); err != nil {
+
+		// it didn't
+		t.Fatalf("the breaker is off, but it refused a request: %v", err)
+
+	}
+
+}
+
+// a request that tries the server after the cooldown, and is cancelled
+// while waiting to retry, has to let the next request try it
+func TestBreakerCancelledTrial(t *testing.T) {
+
+	// a server that keeps failing
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// fail
+		w.WriteHeader(http.StatusServiceUnavailable)
+
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	// with the breaker open, and the cooldown over
+	u := testUpstreams(&callPolicy{retries: 2, backoff: time.Hour, threshold: 1, cooldown: time.Hour})
+	b := u.breaker(host)
+	b.failures = 1
+	b.openUntil = time.Now().Add(-time.Second)
+
+	// send one that gives up while waiting to retry
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	if _, err := u.send(host, req); !errors.Is(err, context.DeadlineExceeded) {
+
+		// it should have been cancelled
+		t.Fatalf("expected the request to be cancelled, got %v", err)
+
+	}
+
+	// it isn't trying anymore
+	b.lock.Lock()
+	trying := b.trying
+	b.lock.Unlock()
+	if trying {
+
+		// it still is
+		t.Fatalf("the breaker is still waiting on a request that was cancelled")
+
+	}
+
+	// and once the cooldown is over again, another one can try
+	b.lock.Lock()
+	b.openUntil = time.Now().Add(-time.Second)
+	b.lock.Unlock()
+	if err := b.allow(host, u.policy(host)); err != nil {
+
+		// it can't
+		t.Fatalf("no request can try the server after a cancelled one: %v", err)
+
+	}
+
+}
+
+// call policies are made from the settings, with defaults for the
+// ones that aren't set, and refuse settings that don't make sense
+func TestCallPolicyFrom(t *testing.T) {
+
+	// the policy with nothing set
+	defaults := callPolicy{
+
+		connectTimeout: 10 * time.Second,
+		tlsTimeout:     10 * time.Second,
+		headerTimeout:  30 * time.Second,
+		retries:        2,
+		backoff:        250 * time.Millisecond,
+		threshold:      5,
+		cooldown:       30 * time.Second,
+	}
+
+	// each set of settings, and the policy they should make
+	tests := []struct {
+		name     string
+		settings map[string]string
+		change   func(policy *callPolicy)
+		ok       bool
+	}{
+		{"nothing set", map[string]string{}, func(policy *callPolicy) {}, true},
+		{"timeouts", map[string]string{"connectTimeout": "1s", "tlsTimeout": "2s", "headerTimeout": "3s", "requestTimeout": "1m"}, func(policy *callPolicy) {
+			policy.connectTimeout, policy.tlsTimeout, policy.headerTimeout, policy.totalTimeout = time.Second, 2*time.Second, 3*time.Second, time.Minute
+		}, true},
+		{"no retries", map[string]string{"retries": "0"}, func(policy *callPolicy) { policy.retries = 0 }, true},
+		{"backoff", map[string]string{"retryBackoff": "1.5s"}, func(policy *callPolicy) { policy.backoff = 1500 * time.Millisecond }, true},
+		{"breaker off", map[string]string{"breakerThreshold": "0"}, func(policy *callPolicy) { policy.threshold = 0 }, true},
+		{"cooldown", map[string]string{"breakerCooldown": "2m"}, func(policy *callPolicy) { policy.cooldown = 2 * time.Minute }, true},
+		{"a timeout without a unit", map[string]string{"connectTimeout": "10"}, nil, false},
+		{"a negative timeout", map[string]string{"headerTimeout": "-1s"}, nil, false},
+		{"a timeout that isn't one", map[string]string{"requestTimeout": "forever"}, nil, false},
+		{"negative retries", map[string]string{"retries": "-1"}, nil, false},
+		{"retries that aren't a number", map[string]string{"retries": "two"}, nil, false},
+		{"a negative threshold", map[string]string{"breakerThreshold": "-5"}, nil, false},
+		{"a threshold that isn't a number", map[string]string{"breakerThreshold": "1.5"}, nil, false},
+		{"a negative cooldown", map[string]string{"breakerCooldown": "-30s"}, nil, false},
+	}
+
+	// check each of them
+	for _, test := range tests {
+
+		// make it
+		policy, err := callPolicyFrom(func(name string, def string) string {
+
+			// use the setting if it is there
+			if value, ok := test.settings[name]; ok {
+
+				// it is
+				return value
+
+			}
+			return def
+
+		})
+		if !test.ok {
+
+			// it should have failed
+			if err == nil {
+
+				// it didn't
+				t.Fatalf("%s: expected an error, got %+v", test.name, *policy)
+
+			}
+			continue
+
+		}
+		if err != nil {
+
+			// it shouldn't have
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+
+		}
+
+		// check it
+		want := defaults
+		test.change(&want)
+		if *policy != want {
+
+			// it is wrong
+			t.Fatalf("%s: expected %+v, got %+v", test.name, want, *policy)
+
+		}
+
+	}
+
+}
@@ -14,13 +14,14 @@ package main
 import (
 	// internals
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -28,16 +29,73 @@ import (
 )
 
 // cert generation function here so i don't need to rewrite it in maryo.go
-// (adapted from https://www.socketloop.com/tutorials/golang-create-x509-certificate-private-and-public-keys)
 func doCertGen(config string) {
-	// variable stuff
-	var notBefore time.Time
 
 	// clear the screen because why not?
 	clear()
 
-	// show a neat info snippet
-	fmt.Printf("- generating certificate and key pair...\n")
+	// generate the cert and key pair
+	generateCerts()
+
+	// then, say they were made
+	fmt.Printf("\npress enter to continue...\n")
+	_ = input("")
+
+	// then ask if they would like to enable https
+	// on the server
+	var enableHTTPS string
+	for true {
+
+		// clear the screen
+		clear()
+
+		// display the message
+		fmt.Printf("would you like to enable https on the server?\n")
+		fmt.Printf("-> (y|n)\n")
+		enableHTTPS = input(": ")
+
+		// make sure it is a valid option
+		if (enableHTTPS == "y") || (enableHTTPS == "n") {
+
+			// exit loop if it is
+			break
+
+		// if it isn't
+		} else {
+
+			// show a message showing valid options
+			fmt.Printf("-> please enter y or n\n")
+
+			// stop the event loop to give them time to read
+			time.Sleep(1500 * time.Millisecond)
+
+		}
+
+	}
+
+	// clear for a sec
+	clear()
+
+	// do as requested
+	setHTTPS(config, (enableHTTPS == "y"))
+
+	// let the user know it's done, and exit on enter
+	fmt.Printf("finished modifying the config...\n")
+	fmt.Printf("press enter to continue...\n")
+	_ = input("")
+
+}
+
+// generate the cert and key pair without asking anything
+func generateCerts() {
+
+	// use the default options
+	generateCertsWith(defaultCertOptions)
+
+}
+
+// generate the cert and key pair in maryo-data with the given options
+func generateCertsWith(opts certOptions) {
 
 	// create necissary directories for this
 
@@ -67,6 +125,22 @@ func doCertGen(config string) {
 
 	}
 
+	// generate them
+	generateCertsTo(opts, "maryo-data/cert.pem", "maryo-data/cert.key")
+
+}
+
+// generate a cert and key pair with the given options, writing them to
+// certFile and keyFile
+// (adapted from https://www.socketloop.com/tutorials/golang-create-x509-certificate-private-and-public-keys)
+func generateCertsTo(opts certOptions, certFile string, keyFile string) {
+
+	// variable stuff
+	var notBefore time.Time
+
+	// show a neat info snippet
+	fmt.Printf("- generating certificate and key pair...\n")
+
 	// serial number limit stuff
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
@@ -83,7 +157,7 @@ func doCertGen(config string) {
 	notBefore = time.Now()
 
 	// cert valid after date
-	notAfter := notBefore.Add(365*24*time.Hour)
+	notAfter := notBefore.Add(time.Duration(opts.days)*24*time.Hour)
 
 	// populate certificate with data
     template := &x509.Certificate {
@@ -93,8 +167,8 @@ func doCertGen(config string) {
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 
-			CommonName:   "maryo-cert",
-			Organization: []string{"pretendo"},
+			CommonName:   opts.commonName,
+			Organization: []string{opts.organization},
 			Country:      []string{"US"},
 
 		},
@@ -105,8 +179,11 @@ func doCertGen(config string) {
 
 	}
 
+	// add the subject alternative names
+	addSANs(template, opts.sans)
+
 	// generate private key
-	privatekey, err := rsa.GenerateKey(rand.Reader, 2048)
+	privatekey, err := generateKey(opts)
 
 	// check for errors
 	if err != nil {
@@ -119,8 +196,16 @@ func doCertGen(config string) {
 
 	}
 
+	// only rsa keys can be used for key encipherment
+	if opts.keyType != "rsa" {
+
+		// drop it
+		template.KeyUsage &^= x509.KeyUsageKeyEncipherment
+
+	}
+
 	// get the public key
-	publickey := &privatekey.PublicKey
+	publickey := privatekey.Public()
 
 	// create a self-signed certificate. template = parent
 	var parent = template
@@ -138,7 +223,7 @@ func doCertGen(config string) {
 	}
 
 	// save cert
-	certOut, err := os.Create("maryo-data/cert.pem")
+	certOut, err := os.Create(certFile)
 	if err != nil {
 
 		// display error
@@ -170,7 +255,7 @@ func doCertGen(config string) {
 	fmt.Printf("certificate saved...\n")
 
 	// save private key
-	keyOut, err := os.OpenFile("maryo-data/cert.key", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	keyOut, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		fmt.Print("failed to open the keypair for writing...\n")
 
@@ -178,7 +263,15 @@ func doCertGen(config string) {
 		panic(err)
 
 	}
-	if err := pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privatekey)}); err != nil {
+	keyBlock, err := marshalKeyPEM(privatekey)
+	if err != nil {
+		fmt.Print("failed to encode the keypair...\n")
+
+		// panic
+		panic(err)
+
+	}
+	if err := pem.Encode(keyOut, keyBlock); err != nil {
 		fmt.Print("failed to write data to the keypair...\n")
 
 		// panic
@@ -196,43 +289,11 @@ func doCertGen(config string) {
 
 	// then, say they were made
 	fmt.Printf("finished generating the cert and key pair...\n")
-	fmt.Printf("\npress enter to continue...\n")
-	_ = input("")
-
-	// then ask if they would like to enable https
-	// on the server
-	var enableHTTPS string
-	for true {
-
-		// clear the screen
-		clear()
-
-		// display the message
-		fmt.Printf("would you like to enable https on the server?\n")
-		fmt.Printf("-> (y|n)\n")
-		enableHTTPS = input(": ")
-
-		// make sure it is a valid option
-		if (enableHTTPS == "y") || (enableHTTPS == "n") {
-
-			// exit loop if it is
-			break
-
-		// if it isn't
-		} else {
-
-			// show a message showing valid options
-			fmt.Printf("-> please enter y or n\n")
-
-			// stop the event loop to give them time to read
-			time.Sleep(1500 * time.Millisecond)
-
-		}
 
-	}
+}
 
-	// clear for a sec
-	clear()
+// enable or disable https in the config
+func setHTTPS(config string, enable bool) {
 
 	// check if the config even exists
 	if !doesFileExist(config) {
@@ -266,27 +327,12 @@ func doCertGen(config string) {
 	// load it if it is
 	configData := readJSONFile(config)
 
-	// do as requested
-	if enableHTTPS == "y" {
-
-		// enable https in the config
-		configData["config"].(map[string]interface{})["https"] = true
-
-	} else if enableHTTPS == "n" {
-
-		// keep https disabled
-		configData["config"].(map[string]interface{})["https"] = false
-
-	}
+	// set https in the config
+	configData["config"].(map[string]interface{})["https"] = enable
 
 	// write the log back
 	writeJSONFile(config, configData)
 
-	// let the user know it's done, and exit on enter
-	fmt.Printf("finished modifying the config...\n")
-	fmt.Printf("press enter to continue...\n")
-	_ = input("")
-
 }
 
 func generateRomFSPatch(encryptionKeyPath string) {
@@ -342,10 +388,10 @@ func generateRomFSPatch(encryptionKeyPath string) {
 
 	// check for the aes key required for the
 	// console to accept the cert and pubkey
-	if !doesFileExist("maryo-data/0x0D.key") {
+	if !doesFileExist(encryptionKeyPath) {
 
 		// if it doesn't
-		fmt.Printf("[err]: slot key 0x0D not found in maryo-data...\n")
+		fmt.Printf("[err]: slot key 0x0D not found at %s...\n", encryptionKeyPath)
 		fmt.Printf("       please dm me for my magnet link, torrent it,\n")
 		fmt.Printf("       and place it in the maryo-data directory as 0x0D.key...\n")
 
@@ -354,10 +400,57 @@ func generateRomFSPatch(encryptionKeyPath string) {
 
 	}
 
+	// load the key, making sure it is the right size
+	key, err := readSlotKey(encryptionKeyPath)
+	if err != nil {
+
+		// it isn't
+		fmt.Printf("[err]: the 0x0D slot key is the wrong size...\n")
+		fmt.Printf("       %s\n", err.Error())
+
+		// exit
+		os.Exit(1)
+
+	}
+
+	// load the cert out of its pem file
+	certData, err := readPEMFile("maryo-data/cert.pem")
+	if err != nil {
+
+		// it isn't a pem file
+		fmt.Printf("[err]: the cert in maryo-data couldn't be read...\n")
+		fmt.Printf("       %s\n", err.Error())
+
+		// exit
+		os.Exit(1)
+
+	}
+
+	// and the key, which has to be rsa like the title's
+	cert, err := x509.ParseCertificate(certData)
+	var keyData []byte
+	if err == nil {
+
+		// read it
+		keyData, err = readPatchKey("maryo-data/cert.key", cert)
+
+	}
+	if err != nil {
+
+		// it can't go in the patch
+		fmt.Printf("[err]: the key in maryo-data can't be put in the patch...\n")
+		fmt.Printf("       %s\n", err.Error())
+		fmt.Printf("       run maryo cert generate --key-type rsa to make one that can\n")
+
+		// exit
+		os.Exit(1)
+
+	}
+
 	// now, we can begin generating the patch
 
 	// alert
-	fmt.Printf("generating patch...")
+	fmt.Printf("generating an experimental patch...\n")
 
 	// create directory for the patch
 
@@ -365,7 +458,7 @@ func generateRomFSPatch(encryptionKeyPath string) {
 	if doesDirExist("patch-out") {
 
 		// remove it if it already does
-		deleteFile("patch-out")
+		removeDirectory("patch-out")
 
 	}
 
@@ -376,35 +469,228 @@ func generateRomFSPatch(encryptionKeyPath string) {
 	// require subdirectories
 
 	// title id folder
-	makeDirectory("patch-out/0004001b00010002")
+	makeDirectory(strings.Join([]string{"patch-out/", patchTitle}, ""))
 
 	// romfs folder
-	makeDirectory("patch-out/0004001b00010002/romfs")
+	makeDirectory(strings.Join([]string{"patch-out/", patchTitle, "/romfs"}, ""))
 
 	// and now all we have to do
 	// is encrypt the cert and key with
 	// the 0x0D aes key
+	writePatchFile(key, certData, strings.Join([]string{"patch-out/", patchTitle, "/romfs/", patchCertFile}, ""))
+	writePatchFile(key, keyData, strings.Join([]string{"patch-out/", patchTitle, "/romfs/", patchKeyFile}, ""))
+
+	// let the user know it's done, and that it might not work
+	fmt.Printf("finished generating the patch in patch-out...\n")
+	consoleSequence(fmt.Sprintf("-> %sthe format of these files is maryo's guess, and hasn't been checked against\n", code("yellow")))
+	consoleSequence(fmt.Sprintf("   how the title reads them, so the console may not accept this patch%s\n", code("reset")))
+
+}
+
+// result of testing one service on one server
+type testResult struct {
+	service string
+	using   string
+	working bool
+}
+
+// test a single service on a server
+func testService(service string, using string) bool {
 
-	/*
+	// get the json
+	res, err := getWithTimeout(strings.Join([]string{"http://", testEndpoints[using][service], "/isthisworking"}, ""), testTimeout)
 
-	aaannnd... since i can't figure out how to get past this point...
+	// the request failed
+	if (err != nil) || (res == "") {
 
-	there won't be any  dev here for a bit...
+		// it doesn't work
+		return false
 
-	*/
+	}
+
+	// prepare a struct for the json
+	var parsedRes isitworkingStruct
+
+	// parse it
+	err = json.Unmarshal([]byte(res), &parsedRes)
+
+	// if it isn't JSON, it isn't our server
+	if err != nil {
+
+		// it doesn't work
+		return false
+
+	}
+
+	// check that it is the server we expected
+	return (parsedRes.Server == resMap[service])
 
 }
 
-// setup function goes here now
-func setup(fileMap map[string]string) {
+// test every service on the local and official servers at
+// the same time, and build a config that uses the best
+// working server for each of them
+func automaticConfig() (map[string]map[string]interface{}, bool) {
+
+	// servers to test, in order of priority
+	servers := []string{"local", "official"}
+
+	// names to show for them
+	serverNames := map[string]string{"local": "local", "official": "pretendo"}
+
+	// show some messages
+	fmt.Printf("-- beginning tests\n")
+	fmt.Printf(" testing %d services on %d servers\n", len(testServices), len(servers))
+
+	// channel for the results
+	results := make(chan testResult)
+
+	// test everything at once
+	for _, service := range testServices {
+
+		// on each server
+		for _, using := range servers {
+
+			// test it
+			go func(service string, using string) {
+
+				// send the result back
+				results <- testResult{service: service, using: using, working: testService(service, using)}
+
+			}(service, using)
+
+		}
+
+	}
+
+	// map of which services work on which servers
+	working := make(map[string]map[string]bool)
+	for _, using := range servers {
+
+		// make the map
+		working[using] = make(map[string]bool)
+
+	}
+
+	// show each result as it comes in
+	for x := 0; x < len(testServices)*len(servers); x++ {
+
+		// get the result
+		result := <-results
+		working[result.using][result.service] = result.working
+
+		// show it
+		if result.working == true {
+
+			// MS, step your game up and support ansi escape codes
+			consoleSequence(fmt.Sprintf("  %s%s%s%s %s -> %s (%s)\n", code("green"), code("bold"), utilIcons["success"], code("reset"), testEndpoints["ninty"][result.service], testEndpoints[result.using][result.service], serverNames[result.using]))
 
-	// test data
-	test := make([]string, 1)
-	test[0] = "account"
+		} else {
+
+			// make windows great again (as if it ever was)
+			consoleSequence(fmt.Sprintf("  %s%s%s%s %s -> %s (%s)\n", code("red"), code("bold"), utilIcons["failiure"], code("reset"), testEndpoints["ninty"][result.service], testEndpoints[result.using][result.service], serverNames[result.using]))
+
+		}
+
+	}
+
+	// make a map for the config
+	config := make(map[string]map[string]interface{})
+
+	// make the endpoints and config a map[string]interface{}
+	config["endpoints"] = make(map[string]interface{})
+	config["config"] = make(map[string]interface{})
+
+	// we only need to decrypt outgoing connections for local servers,
+	// so keep track of which services use them
+	local := []string{}
+
+	// print out the results and pick a server for each service
+	fmt.Printf("-- printing results of tests\n")
+	for _, service := range testServices {
+
+		// pick the first server that works
+		picked := ""
+		for _, using := range servers {
+
+			// check if it works
+			if working[using][service] == true {
+
+				// use it
+				picked = using
+				break
+
+			}
+
+		}
+
+		// nothing works for this service
+		if picked == "" {
+
+			// show an uncertain message
+			fmt.Printf(" %s %s: no working server\n", utilIcons["uncertain"], service)
+			continue
+
+		}
+
+		// show which one we picked
+		fmt.Printf(" %s %s: %s\n", utilIcons["success"], service, serverNames[picked])
+
+		// set it in the config
+		config["endpoints"][testEndpoints["ninty"][service]] = testEndpoints[picked][service]
+
+		// remember if it is local
+		if picked == "local" {
+
+			// it is
+			local = append(local, testEndpoints["ninty"][service])
+
+		}
+
+	}
+
+	// no servers work at all
+	if len(config["endpoints"]) == 0 {
+
+		// nothing to make a config out of
+		return nil, false
 
-	// test the 'official' pretendo servers
-	testOfficial := make([]string, 1)
-	testOfficial[0] = "account"
+	}
+
+	// set some config vars
+	if len(local) == len(config["endpoints"]) {
+
+		// local servers don't speak https
+		config["config"]["decryptOutgoing"] = "true"
+
+	} else {
+
+		// the official ones do
+		config["config"]["decryptOutgoing"] = "false"
+
+		// so only the services on local servers use http
+		if len(local) != 0 {
+
+			// set it for each of them
+			config["endpointConfig"] = make(map[string]interface{})
+			for _, host := range local {
+
+				// set it
+				config["endpointConfig"][host] = map[string]interface{}{"decryptOutgoing": "true"}
+
+			}
+
+		}
+
+	}
+
+	// return the config
+	return config, true
+
+}
+
+// setup function goes here now
+func setup(fileMap map[string]string) {
 
 	// file status map
 	fileStat := make(map[string]string)
@@ -470,7 +756,7 @@ func setup(fileMap map[string]string) {
 	}
 
 	// create config var
-	var config map[string]map[string]string
+	var config map[string]map[string]interface{}
 
 	// show log when
 	clear()
@@ -483,270 +769,40 @@ func setup(fileMap map[string]string) {
 
 		// show some messages
 		fmt.Printf(" method: automatic..\n")
-		fmt.Printf("-- beginning tests\n")
-		fmt.Printf(" 1. attempting to detect endpoints running on this machine\n")
-
-		// test for endpoints on this machine
-		result := make([]bool, len(test))
-		for x := 0; x < len(test); x++ {
 
-			// test the endpoint
-			fmt.Printf("  %s %s -> %s", utilIcons["uncertain"], testEndpoints["ninty"][test[x]], testEndpoints["local"][test[x]])
+		// run the tests and build a config from them
+		var ok bool
+		config, ok = automaticConfig()
 
-			// get the json
-			res, err := get(strings.Join([]string{"http://", testEndpoints["local"][test[x]], "/isthisworking"}, ""))
+		// no servers work
+		if ok == false {
 
-			// prepare a struct for the json
-			var parsedRes isitworkingStruct
+			// exit the program
+			clear()
+			fmt.Printf("no servers are running currently, please try again later.")
+			os.Exit(0)
 
-			// parse it
-			err2 := json.Unmarshal([]byte(res), &parsedRes)
+		}
 
-			// make sure it isn't empty
-			if res != "" {
+		// wait for them to press enter
+		fmt.Printf("\npress enter to continue...\n")
+		_ = input("")
 
-				// if there is an error in JSON parsing
-				if err2 != nil {
+		// creating a custom config
+	} else if method == "2" {
 
-					// and not an error with the request
-					if err == nil {
-
-						// show a message
-						fmt.Printf("\n[err] : error when parsing JSON during validating %s server\n", test[x])
-
-						// show a traceback
-						panic(err2)
-
-					}
-
-				}
-
-			}
-
-			// handle the results
-			if (parsedRes.Server == resMap[test[x]]) && (err == nil) && (res != "") {
-
-				// MS, step your game up and support ansi escape codes
-				consoleSequence(fmt.Sprintf("%s\n", padStrToMatchStr(fmt.Sprintf("\r  %s%s%s%s %s -> %s", code("green"), code("bold"), utilIcons["success"], code("reset"), testEndpoints["ninty"][test[x]], testEndpoints["local"][test[x]]), fmt.Sprintf("  %s %s -> %s", utilIcons["uncertain"], testEndpoints["ninty"][test[x]], testEndpoints["local"][test[x]]), " ")))
-				result[x] = true
-
-			} else {
-
-				// make windows great again (as if it ever was)
-				consoleSequence(fmt.Sprintf("%s\n", padStrToMatchStr(fmt.Sprintf("\r  %s%s%s%s %s -> %s", code("red"), code("bold"), utilIcons["failiure"], code("reset"), testEndpoints["ninty"][test[x]], testEndpoints["local"][test[x]]), fmt.Sprintf("  %s %s -> %s", utilIcons["uncertain"], testEndpoints["ninty"][test[x]], testEndpoints["local"][test[x]]), " ")))
-				result[x] = false
-
-			}
-
-		}
-
-		// show the user that we are detecting the official server
-		fmt.Printf(" 2. attempting to test endpoints on the official server\n")
-
-		// test for endpoints on the official pretendo servers
-		resultOfficial := make([]bool, len(testOfficial))
-		for x := 0; x < len(testOfficial); x++ {
-
-			// test the endpoint
-			fmt.Printf("  %s %s -> %s", utilIcons["uncertain"], testEndpoints["ninty"][testOfficial[x]], testEndpoints["official"][testOfficial[x]])
-
-			// get the json
-			res2, err3 := get(strings.Join([]string{"http://", testEndpoints["official"][testOfficial[x]], "/isthisworking"}, ""))
-			// prepare a struct for the json
-			var parsedRes2 isitworkingStruct
-
-			// parse it
-			err4 := json.Unmarshal([]byte(res2), &parsedRes2)
-
-			// make sure the request isn't empty
-			if res2 != "" {
-
-				// if there is an error in JSON parsing
-				if err4 != nil {
-
-					// and not an error with the request
-					if err3 == nil {
-
-						// show an error message
-						fmt.Printf("\n[err] : error when parsing JSON during validating %s server\n", testOfficial[x])
-
-						// and show a traceback
-						panic(err4)
-
-					}
-
-				}
-
-			}
-
-			// handle the results
-			if (parsedRes2.Server == resMap[testOfficial[x]]) && (err3 == nil) && (res2 != "") {
-
-				// why is windows like this
-				consoleSequence(fmt.Sprintf("%s\n", padStrToMatchStr(fmt.Sprintf("\r  %s%s%s%s %s -> %s", code("green"), code("bold"), utilIcons["success"], code("reset"), testEndpoints["ninty"][testOfficial[x]], testEndpoints["official"][testOfficial[x]]), fmt.Sprintf("  %s %s -> %s", utilIcons["uncertain"], testEndpoints["ninty"][testOfficial[x]], testEndpoints["official"][testOfficial[x]]), " ")))
-				resultOfficial[x] = true
-
-			} else {
-
-				// thank goodness for my shorthand function
-				consoleSequence(fmt.Sprintf("%s\n", padStrToMatchStr(fmt.Sprintf("\r  %s%s%s%s %s -> %s", code("red"), code("bold"), utilIcons["failiure"], code("reset"), testEndpoints["ninty"][testOfficial[x]], testEndpoints["official"][testOfficial[x]]), fmt.Sprintf("  %s %s -> %s", utilIcons["uncertain"], testEndpoints["ninty"][testOfficial[x]], testEndpoints["official"][testOfficial[x]]), " ")))
-				resultOfficial[x] = false
-
-			}
-
-		}
-
-		// print out the results
-		fmt.Printf("-- printing results of tests\n")
-
-		// for local servers
-		for x := 0; x < len(result); x++ {
-
-			// add a header saying that these are local results
-			fmt.Printf("- local\n")
-
-			// print the results
-			if result[x] == true {
-
-				// show a successful message
-				fmt.Printf(" %s: success\n", test[x])
-
-			} else {
-
-				// or a failiure message
-				fmt.Printf(" %s: failiure\n", test[x])
-
-			}
-
-		}
-
-		// for the official servers
-		for x := 0; x < len(resultOfficial); x++ {
-
-			// add a header saying that these are official results
-			fmt.Printf("- pretendo\n")
-
-			// print the results
-			if resultOfficial[x] == true {
-
-				// if successful
-				fmt.Printf(" %s: success\n", testOfficial[x])
-
-			} else {
-
-				// or failed
-				fmt.Printf(" %s: failiure\n", testOfficial[x])
-
-			}
-
-		}
-
-		// begin generating the config
-		fmt.Printf("-- generating config\n")
-
-		// create cfgTest, cfgResult, using, and useLocal variables
-		// also make the really long name variable
-		var using string
-		var cfgTest []string
-		var cfgResult []bool
-		var useLocal bool
-		var doesOfficialHaveAnyWorkingEndpoints bool
-
-		// scan the local server result list to see if any are true, since they have priority
-		useLocal = false
-
-		// scan it
-		for x := 0; x < len(result); x++ {
-
-			// if it works, use local servers
-			if result[x] == true {
-
-				// set the variable
-				useLocal = true
-
-			}
-
-		}
-
-		// local servers have priority
-		if useLocal == true {
-
-			// set the needed variables
-			using = "local"
-			cfgTest = test
-			cfgResult = result
-
-		} else {
-
-			// check this first to see if official even works
-			for x := 0; x < len(resultOfficial); x++ {
-				doesOfficialHaveAnyWorkingEndpoints = false
-				if resultOfficial[x] == true {
-					doesOfficialHaveAnyWorkingEndpoints = true
-				}
-			}
-
-			// if the official servers work
-			if doesOfficialHaveAnyWorkingEndpoints == true {
-
-				// set these if it does
-				using = "official"
-				cfgTest = testOfficial
-				cfgResult = resultOfficial
-
-			} else {
-
-				// exit the program
-				clear()
-				fmt.Printf("no servers are running currently, please try again later.")
-				os.Exit(0)
-
-			}
-
-		}
-
-		// make a map for the config
-		config = make(map[string]map[string]string)
-
-		// make the endpoints and config a map[string]string
-		config["endpoints"] = make(map[string]string)
-		config["config"] = make(map[string]string)
-
-		// apply a nice helping of all of the working endpoints to the config
-		for x := 0; x < len(cfgTest); x++ {
-
-			// if this endpoint works
-			if cfgResult[x] == true {
-
-				// set it in the config
-				config["endpoints"][testEndpoints["ninty"][cfgTest[x]]] = testEndpoints[using][cfgTest[x]]
-
-			}
-
-		}
-
-		// set some config vars
-		config["config"]["decryptOutgoing"] = "true"
-
-		// wait for them to press enter
-		fmt.Printf("\npress enter to continue...\n")
-		_ = input("")
-
-		// creating a custom config
-	} else if method == "2" {
-
-		// show a little message
-		fmt.Printf(" method: custom..\n")
+		// show a little message
+		fmt.Printf(" method: custom..\n")
 
 		// number of values in the config
 		numVals := 0
 
 		// config
-		config = make(map[string]map[string]string)
+		config = make(map[string]map[string]interface{})
 
-		// make the endpoints and config a map[string]string
-		config["endpoints"] = make(map[string]string)
-		config["config"] = make(map[string]string)
+		// make the endpoints and config a map[string]interface{}
+		config["endpoints"] = make(map[string]interface{})
+		config["config"] = make(map[string]interface{})
 
 		// temp vars
 		var inputtedFrom string
@@ -803,6 +859,12 @@ func setup(fileMap map[string]string) {
 		// template variable since i have to reserve it
 		var tmpl string
 
+		// the selected template
+		var selected int
+
+		// load the list of templates
+		templates := loadTemplates()
+
 		// ask for choice
 		fmt.Printf(" method: template..\n")
 		for true {
@@ -812,18 +874,20 @@ func setup(fileMap map[string]string) {
 
 			// show ui
 			fmt.Printf("-- please select a template\n")
-			fmt.Printf(" 1. local server\n")
-			fmt.Printf(" 2. pretendo servers\n")
-			// TODO: make official servers work
-			// not adding this one until i can figure out how
-			// to make ClientCertificate.cer work
-			// fmt.Printf(" 3. official servers\n")
+			for x := 0; x < len(templates); x++ {
+
+				// show the template
+				fmt.Printf(" %d. %s - %s\n", x+1, templates[x].Name, templates[x].Description)
+
+			}
 
 			// ask for input
 			tmpl = input(": ")
 
 			// break if it's a valid option
-			if (tmpl == "1") || (tmpl == "2") {
+			var err error
+			selected, err = strconv.Atoi(tmpl)
+			if (err == nil) && (selected >= 1) && (selected <= len(templates)) {
 
 				// break
 				break
@@ -831,7 +895,7 @@ func setup(fileMap map[string]string) {
 			} else {
 
 				// otherwise show a help message
-				fmt.Printf("-> please enter 1 or 2\n")
+				fmt.Printf("-> please enter a number from 1 to %d\n", len(templates))
 
 				// sleep to let them read it
 				time.Sleep(1500 * time.Millisecond)
@@ -841,24 +905,21 @@ func setup(fileMap map[string]string) {
 		}
 
 		// load the selected template into the config var
-		// TODO: add variable templates
-		if tmpl == "1" {
-
-			// load the template
-			config = localConf
-
-		} else if tmpl == "2" {
-
-			// load this other template
-			config = pretendoConf
-
-		}
+		config = templates[selected-1].config()
 
 	}
 
 	// not everyone wants to generate a new config
 	if method != "4" {
 
+		// ask which address the console should connect to
+		if iface := chooseInterface(); iface != "" {
+
+			// save it in the config
+			config["config"]["interface"] = iface
+
+		}
+
 		// prettify the JSON
 		stringifiedConfig, err := json.MarshalIndent(config, "", "    ")
 
@@ -940,60 +1001,8 @@ func setup(fileMap map[string]string) {
 
 		}
 
-		// make sure the maryo folder exists
-		if doesDirExist("maryo-data") == false {
-
-			// make it if it doesn't
-			makeDirectory("maryo-data")
-
-		}
-
 		// place it into the file
-		if fileMap["config"] == "iv" {
-
-			// delete the existing config
-			deleteFile("maryo-data/config.json")
-
-			// create a new one
-			createFile("maryo-data/config.json")
-
-			// write the data to the file
-			writeByteToFile("maryo-data/config.json", stringifiedConfig)
-
-		} else if fileMap["config"] == "ne" {
-
-			// create the config
-			createFile("maryo-data/config.json")
-
-			// write the config to the file
-			writeByteToFile("maryo-data/config.json", stringifiedConfig)
-
-		} else if fileMap["config"] == "uk" {
-
-			// detect status of config and do the
-			// things to write to it.
-			if doesFileExist("maryo-data/config.json") == true {
-
-				// delete existing config
-				deleteFile("maryo-data/config.json")
-
-				// create a new one
-				createFile("maryo-data/config.json")
-
-				// write the config to it
-				writeByteToFile("maryo-data/config.json", stringifiedConfig)
-
-			} else {
-
-				// create the config
-				createFile("maryo-data/config.json")
-
-				// write the config to the file
-				writeByteToFile("maryo-data/config.json", stringifiedConfig)
-
-			}
-
-		}
+		writeConfig("maryo-data/config.json", stringifiedConfig)
 
 	}
 
@@ -1038,3 +1047,405 @@ func setup(fileMap map[string]string) {
 	fmt.Printf("run this program again to use the new configuration\n")
 
 }
+
+// ask which network interface the console should connect to.
+// returns an empty string to pick one automatically
+func chooseInterface() string {
+
+	// list the addresses
+	addresses, err := listAddresses()
+
+	// nothing to choose from
+	if (err != nil) || (len(addresses) < 2) {
+
+		// pick automatically
+		return ""
+
+	}
+
+	// the choice
+	var choice string
+	for true {
+
+		// clear the screen
+		clear()
+
+		// show the ui
+		fmt.Printf("== maryo -> setup ===========================================\n")
+		fmt.Printf("                                        Steps:               \n")
+		fmt.Printf(" which address should your console        intro              \n")
+		fmt.Printf(" connect to?                            > config creation    \n")
+		fmt.Printf("                                          confirm prefs      \n")
+		fmt.Printf("                                          make https work    \n")
+		fmt.Printf("                                          profit???          \n")
+		for x := 0; x < len(addresses); x++ {
+
+			// show the address
+			fmt.Printf(" %d. %s\n", x+1, addresses[x].String())
+
+		}
+		fmt.Printf("                                                             \n")
+		fmt.Printf(" -> press enter to pick one automatically                    \n")
+		fmt.Printf("=============================================================\n")
+		choice = input(": ")
+
+		// automatic
+		if choice == "" {
+
+			// pick automatically
+			return ""
+
+		}
+
+		// check if it's a valid option
+		selected, err := strconv.Atoi(choice)
+		if (err == nil) && (selected >= 1) && (selected <= len(addresses)) {
+
+			// use the interface name
+			return addresses[selected-1].iface
+
+		}
+
+		// otherwise show a help message
+		fmt.Printf("-> please enter a number from 1 to %d\n", len(addresses))
+
+		// sleep to let them read it
+		time.Sleep(1500 * time.Millisecond)
+
+	}
+
+	// never reached
+	return ""
+
+}
+
+// write a generated config to a file, replacing any
+// config that was already there
+func writeConfig(file string, data []byte) {
+
+	// make sure the folder for it exists
+	if doesDirExist(filepath.Dir(file)) == false {
+
+		// make it if it doesn't
+		makeDirectory(filepath.Dir(file))
+
+	}
+
+	// write the config to the file, replacing the existing one
+	writeByteToFile(file, data)
+
+}
+
+// flag value that collects repeated --endpoint from=to pairs
+type endpointList map[string]string
+
+// show the endpoints as a string
+func (e endpointList) String() string {
+
+	// make a list of the pairs
+	pairs := []string{}
+	for from, to := range e {
+
+		// add the pair
+		pairs = append(pairs, strings.Join([]string{from, to}, "="))
+
+	}
+
+	// join them together
+	return strings.Join(pairs, ",")
+
+}
+
+// add an endpoint from a from=to pair
+func (e endpointList) Set(value string) error {
+
+	// split the pair
+	pair := strings.SplitN(value, "=", 2)
+
+	// make sure both sides are there
+	if (len(pair) != 2) || (pair[0] == "") || (pair[1] == "") {
+
+		// return an error
+		return fmt.Errorf("endpoint %q is not in the form from=to", value)
+
+	}
+
+	// add it
+	e[pair[0]] = pair[1]
+
+	// no errors
+	return nil
+
+}
+
+// non-interactive setup, driven by flags or an answers file
+func setupCommand(args []string) {
+
+	// flags for the setup command
+	flags := flag.NewFlagSet("setup", flag.ExitOnError)
+	configPath := flags.String("config", "maryo-data/config.json", "path to write the config to")
+	method := flags.String("method", "", "how to configure the proxy (automatic|custom|template)")
+	tmpl := flags.String("template", "", "name of the template to use (implies --method template)")
+	https := flags.Bool("https", false, "if set, https will be enabled on the server")
+	yes := flags.Bool("yes", false, "if set, the config is written without asking for confirmation")
+	answers := flags.String("answers", "", "path to a JSON answers file to read the setup options from")
+	iface := flags.String("interface", "", "network interface name or ip the console should connect to")
+	endpoints := endpointList{}
+	flags.Var(endpoints, "endpoint", "a from=to redirection to use with --method custom (can be repeated)")
+	flags.Parse(args)
+
+	// with nothing passed, just do the wizard
+	if flags.NFlag() == 0 {
+
+		// run the interactive setup
+		setup(map[string]string{"config": "uk"})
+		return
+
+	}
+
+	// load the answers file first so that flags can override it
+	if *answers != "" {
+
+		// make sure it exists
+		if !doesFileExist(*answers) {
+
+			// show an error message
+			fmt.Printf("[err]: the answers file %s does not exist...\n", *answers)
+			os.Exit(1)
+
+		}
+
+		// parse it
+		var parsedAnswers setupAnswersStruct
+		err := json.Unmarshal(readFileByte(*answers), &parsedAnswers)
+
+		// handle errors
+		if err != nil {
+
+			// show an error message
+			fmt.Printf("[err]: the answers file %s is not valid JSON...\n", *answers)
+			fmt.Printf("       %s\n", err.Error())
+			os.Exit(1)
+
+		}
+
+		// get the flags that were set explicitly
+		setFlags := make(map[string]bool)
+		flags.Visit(func(f *flag.Flag) {
+
+			// mark it as set
+			setFlags[f.Name] = true
+
+		})
+
+		// fill in anything the flags didn't set
+		if !setFlags["config"] && (parsedAnswers.Config != "") {
+
+			// config path
+			*configPath = parsedAnswers.Config
+
+		}
+		if !setFlags["method"] {
+
+			// method
+			*method = parsedAnswers.Method
+
+		}
+		if !setFlags["template"] {
+
+			// template name
+			*tmpl = parsedAnswers.Template
+
+		}
+		if !setFlags["https"] {
+
+			// https
+			*https = parsedAnswers.HTTPS
+
+		}
+		if !setFlags["interface"] {
+
+			// interface
+			*iface = parsedAnswers.Interface
+
+		}
+		if !setFlags["yes"] {
+
+			// confirmation
+			*yes = parsedAnswers.Yes
+
+		}
+		if !setFlags["endpoint"] {
+
+			// endpoints
+			for from, to := range parsedAnswers.Endpoints {
+
+				// add it
+				endpoints[from] = to
+
+			}
+
+		}
+
+	}
+
+	// create config var
+	var config map[string]map[string]interface{}
+
+	// a template on its own means the template method
+	if (*method == "") && (*tmpl != "") {
+
+		// use the template method
+		*method = "template"
+
+	}
+
+	// build the config with the requested method
+	switch *method {
+
+	case "automatic":
+
+		// run the tests
+		var ok bool
+		config, ok = automaticConfig()
+
+		// no servers work
+		if ok == false {
+
+			// show an error message
+			fmt.Printf("[err]: no servers are running currently, please try again later...\n")
+			os.Exit(1)
+
+		}
+
+	case "custom":
+
+		// make sure we have something to redirect
+		if len(endpoints) == 0 {
+
+			// show an error message
+			fmt.Printf("[err]: the custom method needs at least one --endpoint from=to...\n")
+			os.Exit(1)
+
+		}
+
+		// make a map for the config
+		config = make(map[string]map[string]interface{})
+		config["endpoints"] = make(map[string]interface{})
+		config["config"] = make(map[string]interface{})
+
+		// add the endpoints
+		for from, to := range endpoints {
+
+			// set it in the config
+			config["endpoints"][from] = to
+
+		}
+
+		// set default config vars
+		config["config"]["decryptOutgoing"] = "true"
+
+	case "template":
+
+		// make sure a template was given
+		if *tmpl == "" {
+
+			// show an error message
+			fmt.Printf("[err]: the template method needs a --template name...\n")
+			os.Exit(1)
+
+		}
+
+		// load the template
+		var ok bool
+		config, ok = templateConfig(*tmpl)
+
+		// make sure it exists
+		if ok == false {
+
+			// show an error message
+			fmt.Printf("[err]: there is no template named %s...\n", *tmpl)
+			fmt.Printf("       the templates are: %s\n", strings.Join(templateNames(), ", "))
+			os.Exit(1)
+
+		}
+
+	case "":
+
+		// show an error message
+		fmt.Printf("[err]: no setup method given, pass --method or --answers...\n")
+		os.Exit(1)
+
+	default:
+
+		// show an error message
+		fmt.Printf("[err]: %s is not a setup method...\n", *method)
+		fmt.Printf("       please use automatic, custom, or template\n")
+		os.Exit(1)
+
+	}
+
+	// set the interface if one was given
+	if *iface != "" {
+
+		// make sure it exists
+		addresses, _ := listAddresses()
+		if _, ok := pickAddress(addresses, *iface); !ok {
+
+			// show an error message
+			fmt.Printf("[err]: there is no interface or address named %s...\n", *iface)
+			for _, addr := range addresses {
+
+				// show the ones there are
+				fmt.Printf("       %s\n", addr.String())
+
+			}
+			os.Exit(1)
+
+		}
+
+		// save it in the config
+		config["config"]["interface"] = *iface
+
+	}
+
+	// prettify the JSON
+	stringifiedConfig, err := json.MarshalIndent(config, "", "    ")
+
+	// error handling
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: error while prettifying JSON\n")
+
+		// show traceback
+		panic(err)
+
+	}
+
+	// show the config
+	fmt.Printf("%s\n", string(stringifiedConfig[:]))
+
+	// there is nobody to ask for confirmation
+	if *yes == false {
+
+		// show an error message
+		fmt.Printf("[err]: pass --yes to write this config to %s...\n", *configPath)
+		os.Exit(1)
+
+	}
+
+	// place it into the file
+	writeConfig(*configPath, stringifiedConfig)
+	fmt.Printf("config written to %s...\n", *configPath)
+
+	// generate the certificates
+	generateCerts()
+
+	// and set https
+	setHTTPS(*configPath, *https)
+
+	// let the user know it's done
+	fmt.Printf("finished setting up maryo...\n")
+
+}
@@ -0,0 +1,280 @@
+/*
+
+maryo/shutdown.go
+
+stops the proxy cleanly on ctrl-c, letting requests finish,
+closing files, and showing what happened while it ran
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// how many hosts the summary shows
+const summaryHosts = 5
+
+// metrics for the session
+var requestsSeen = newCounter("maryo_requests_total", "requests the proxy has handled")
+
+// what happened while the proxy ran, and what to do when it stops
+type session struct {
+	lock    sync.Mutex
+	started time.Time
+	hosts   map[string]int64
+	active  int64
+	hooks   []func()
+	closers map[int]func()
+	next    int
+}
+
+// the running session
+var currentSession = &session{started: time.Now(), hosts: make(map[string]int64), closers: make(map[int]func())}
+
+// count a request to a host
+func (s *session) request(host string) {
+
+	// count it
+	requestsSeen.add(1)
+	s.lock.Lock()
+	s.hosts[stripHostPort(host)]++
+	s.lock.Unlock()
+
+}
+
+// mark a request as started, giving the func that marks it done
+func (s *session) begin() func() {
+
+	// count it
+	atomic.AddInt64(&s.active, 1)
+
+	// and uncount it when it is done
+	return func() {
+
+		// uncount it
+		atomic.AddInt64(&s.active, -1)
+
+	}
+
+}
+
+// run a func when the proxy stops, like closing a file
+func (s *session) onShutdown(hook func()) {
+
+	// add it
+	s.lock.Lock()
+	s.hooks = append(s.hooks, hook)
+	s.lock.Unlock()
+
+}
+
+// close something right away when the proxy stops, instead of
+// waiting for it. the func given back stops that once it is closed
+func (s *session) closeOnShutdown(closer func()) func() {
+
+	// add it
+	s.lock.Lock()
+	id := s.next
+	s.next++
+	s.closers[id] = closer
+	s.lock.Unlock()
+
+	// and remove it when it is done
+	return func() {
+
+		// remove it
+		s.lock.Lock()
+		delete(s.closers, id)
+		s.lock.Unlock()
+
+	}
+
+}
+
+// wait for the active requests to finish, or the context to end
+func (s *session) drain(ctx context.Context) bool {
+
+	// check every so often
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&s.active) > 0 {
+
+		// wait
+		select {
+
+		case <-ctx.Done():
+
+			// they didn't
+			return false
+
+		case <-ticker.C:
+
+		}
+
+	}
+
+	// they did
+	return true
+
+}
+
+// show what happened while the proxy ran
+func (s *session) summary() {
+
+	// sort the hosts by how many requests they got
+	s.lock.Lock()
+	hosts := []string{}
+	for host := range s.hosts {
+
+		// add it
+		hosts = append(hosts, host)
+
+	}
+	sort.Slice(hosts, func(x, y int) bool {
+
+		// most first, then by name
+		if s.hosts[hosts[x]] != s.hosts[hosts[y]] {
+
+			// most first
+			return s.hosts[hosts[x]] > s.hosts[hosts[y]]
+
+		}
+		return hosts[x] < hosts[y]
+
+	})
+	if len(hosts) > summaryHosts {
+
+		// only the top ones
+		hosts = hosts[:summaryHosts]
+
+	}
+
+	// make it
+	failed := int64(upstreamFailures.current() + breakerFastFails.current() + upstreamVerifyFailures.current())
+	lines := []string{
+		fmt.Sprintf("-> ran for %s", time.Since(s.started).Round(time.Second)),
+		fmt.Sprintf("-> %d request(s), %d error(s), %d upgraded connection(s)", int64(requestsSeen.current()), failed, int64(upgradedConnections.current())),
+	}
+	if len(hosts) != 0 {
+
+		// add the hosts
+		lines = append(lines, "-> top hosts:")
+		for _, host := range hosts {
+
+			// add it
+			lines = append(lines, fmt.Sprintf("   %-40s %d", host, s.hosts[host]))
+
+		}
+
+	}
+	s.lock.Unlock()
+
+	// show it
+	fmt.Printf("\n-- session summary\n%s\n", strings.Join(lines, "\n"))
+	writeLog(fmt.Sprintf("-- session summary\n%s\n", strings.Join(lines, "\n")))
+
+}
+
+// stop the proxy cleanly when asked to. the channel given back is
+// closed once it has stopped
+func shutdownOnSignal(server *http.Server, configData map[string]interface{}) chan struct{} {
+
+	// get how long to wait for requests
+	timeout, err := time.ParseDuration(getSetting(configData, "shutdownTimeout", "10s"))
+	if (err != nil) || (timeout < 0) {
+
+		// use the default
+		fmt.Printf("[err]: shutdownTimeout must be a duration like 5s or 30s, using 10s\n")
+		timeout = 10 * time.Second
+
+	}
+
+	// wait for ctrl-c, or to be told to stop
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+
+		// wait for it
+		<-signals
+		consoleSequence(fmt.Sprintf("\n-> %sstopping, waiting up to %s for requests to finish (press ctrl-c again to stop now)%s\n", code("yellow"), timeout, code("reset")))
+		writeLog("-> stopping\n")
+
+		// stop right away if asked again
+		go func() {
+
+			// wait for it
+			<-signals
+			consoleSequence(fmt.Sprintf("%s\n", code("reset")))
+			os.Exit(1)
+
+		}()
+
+		// close the listeners and upgraded connections
+		currentSession.lock.Lock()
+		closers := []func(){}
+		for _, closer := range currentSession.closers {
+
+			// add it
+			closers = append(closers, closer)
+
+		}
+		currentSession.lock.Unlock()
+		for _, closer := range closers {
+
+			// close it
+			closer()
+
+		}
+
+		// stop taking requests, and let the ones going finish
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if (server.Shutdown(ctx) != nil) || !currentSession.drain(ctx) {
+
+			// they didn't in time
+			consoleSequence(fmt.Sprintf("-> %s%d request(s) didn't finish in time%s\n", code("red"), atomic.LoadInt64(&currentSession.active), code("reset")))
+
+		}
+
+		// show what happened
+		currentSession.summary()
+
+		// close everything, in the reverse order it was opened so
+		// the log is closed last
+		for x := len(currentSession.hooks) - 1; x >= 0; x-- {
+
+			// close it
+			currentSession.hooks[x]()
+
+		}
+
+		// put the terminal back how it was
+		ttitle("")
+		consoleSequence(fmt.Sprintf("%s", code("reset")))
+
+		// it has stopped
+		close(done)
+
+	}()
+
+	// return the channel
+	return done
+
+}
@@ -0,0 +1,413 @@
+/*
+
+maryo/socks.go
+
+a socks5 listener for clients that can't use an http proxy,
+like some emulators and homebrew
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"bufio"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	// externals
+	"github.com/elazarl/goproxy"
+)
+
+// socks5 protocol values (rfc 1928 and 1929)
+const (
+	socksVersion      = 5
+	socksAuthVersion  = 1
+	socksNoAuth       = 0
+	socksUserPass     = 2
+	socksNoMethods    = 0xff
+	socksConnect      = 1
+	socksIPv4         = 1
+	socksDomain       = 3
+	socksIPv6         = 4
+	socksSucceeded    = 0
+	socksFailure      = 1
+	socksNotAllowed   = 2
+	socksBadCommand   = 7
+	socksBadAddress   = 8
+	socksHandshakeMax = 30 * time.Second
+	socksPeekMax      = 5 * time.Second
+)
+
+// metrics for the socks listener
+var socksConnections = newCounter("maryo_socks_connections_total", "connections made to the socks5 listener")
+
+// the socks5 listener
+type socksServer struct {
+	proxy    http.Handler
+	policy   *connectPolicy
+	user     string
+	password string
+}
+
+// start the socks5 listener if the config asks for it
+func startSOCKS(configData map[string]interface{}, proxy http.Handler, policy *connectPolicy, access *accessControl) {
+
+	// get the port
+	port := getSetting(configData, "socksPort", "")
+	if port == "" {
+
+		// it isn't turned on
+		return
+
+	}
+
+	// make the server
+	server := &socksServer{
+
+		proxy:    proxy,
+		policy:   policy,
+		user:     getSetting(configData, "socksUser", access.user),
+		password: getSetting(configData, "socksPassword", access.password),
+	}
+
+	// listen
+	listener, err := net.Listen("tcp", strings.Join([]string{":", port}, ""))
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: couldn't start the socks5 listener on port %s: %s\n", port, err.Error())
+		return
+
+	}
+
+	// stop it with the proxy
+	currentSession.closeOnShutdown(func() { listener.Close() })
+
+	// and only take allowed clients
+	listener = access.listener(listener)
+
+	// let the user know
+	consoleSequence(fmt.Sprintf("-> hosting socks5 proxy on %s:%s%s\n", code("green"), port, code("reset")))
+	writeLog(fmt.Sprintf("-> hosting socks5 proxy on port :%s\n", port))
+
+	// accept connections
+	go func() {
+
+		// forever
+		for {
+
+			// accept one
+			conn, err := listener.Accept()
+			if err != nil {
+
+				// stop if it was closed
+				if errors.Is(err, net.ErrClosed) {
+
+					// it was
+					return
+
+				}
+
+				// show an error message
+				fmt.Printf("[err]: error while accepting a socks5 connection: %s\n", err.Error())
+				continue
+
+			}
+
+			// handle it
+			go server.handle(conn)
+
+		}
+
+	}()
+
+}
+
+// send a reply to a socks5 request
+func socksReply(conn net.Conn, status byte) error {
+
+	// the bound address doesn't mean anything here
+	_, err := conn.Write([]byte{socksVersion, status, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+
+	// return the error
+	return err
+
+}
+
+// handle a socks5 connection
+func (server *socksServer) handle(conn net.Conn) {
+
+	// count it
+	socksConnections.add(1)
+
+	// don't let the handshake take forever
+	conn.SetDeadline(time.Now().Add(socksHandshakeMax))
+
+	// read the handshake
+	reader := bufio.NewReader(conn)
+	target, err := server.handshake(conn, reader)
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: socks5 handshake from %s failed: %s\n", conn.RemoteAddr().String(), err.Error())
+		conn.Close()
+		return
+
+	}
+
+	// the handshake is done. refuse it now if the proxy would, since
+	// the client can't be told once it is sure it worked
+	conn.SetDeadline(time.Time{})
+	if action, reason := server.policy.decide(target); action.Action == goproxy.ConnectReject {
+
+		// refuse it
+		connectReject.add(1)
+		consoleSequence(fmt.Sprintf("-> refusing %s%s%s over socks5 (%s)\n", code("red"), stripHostPort(target), code("reset"), reason))
+		writeLog(fmt.Sprintf("-> refusing %s over socks5 (%s)\n", stripHostPort(target), reason))
+		socksReply(conn, socksNotAllowed)
+		conn.Close()
+		return
+
+	}
+
+	// the client won't send anything until it is told the connection
+	// worked, so tell it that first
+	if socksReply(conn, socksSucceeded) != nil {
+
+		// it went away
+		conn.Close()
+		return
+
+	}
+
+	// look at the first byte, like the transparent listeners do
+	conn.SetReadDeadline(time.Now().Add(socksPeekMax))
+	first, err := reader.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	if (err != nil) && !(errors.As(err, &netErr) && netErr.Timeout()) {
+
+		// it went away
+		conn.Close()
+		return
+
+	}
+
+	// plain http is read request by request, on any port
+	if (err == nil) && (first[0] != tlsHandshakeRecord) {
+
+		// serve it
+		interceptHTTP(server.proxy, &bufferedConn{Conn: conn, reader: reader}, target)
+		return
+
+	}
+
+	// tls, and anything waiting for the server to speak first, goes
+	// through the proxy as a CONNECT. the client was already answered
+	interceptConnect(server.proxy, &bufferedConn{Conn: conn, reader: reader}, target)
+
+}
+
+// do the socks5 handshake, and get the address to connect to
+func (server *socksServer) handshake(conn net.Conn, reader *bufio.Reader) (string, error) {
+
+	// read the greeting
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+
+		// return the error
+		return "", err
+
+	}
+	if header[0] != socksVersion {
+
+		// it isn't socks5
+		return "", fmt.Errorf("socks version %d is not supported", header[0])
+
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+
+		// return the error
+		return "", err
+
+	}
+
+	// pick the method
+	want := byte(socksNoAuth)
+	if server.user != "" {
+
+		// a login is needed
+		want = socksUserPass
+
+	}
+	if !strings.ContainsRune(string(methods), rune(want)) {
+
+		// the client can't use it
+		conn.Write([]byte{socksVersion, socksNoMethods})
+		return "", errors.New("the client doesn't support the needed login method")
+
+	}
+	if _, err := conn.Write([]byte{socksVersion, want}); err != nil {
+
+		// return the error
+		return "", err
+
+	}
+
+	// log in
+	if want == socksUserPass {
+
+		// check it
+		if err := server.login(conn, reader); err != nil {
+
+			// return the error
+			return "", err
+
+		}
+
+	}
+
+	// read the request
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+
+		// return the error
+		return "", err
+
+	}
+	if request[1] != socksConnect {
+
+		// only connect is supported
+		socksReply(conn, socksBadCommand)
+		return "", fmt.Errorf("socks command %d is not supported", request[1])
+
+	}
+
+	// read the address
+	var host string
+	switch request[3] {
+
+	case socksIPv4, socksIPv6:
+
+		// read the ip
+		ip := make([]byte, net.IPv4len)
+		if request[3] == socksIPv6 {
+
+			// it is longer
+			ip = make([]byte, net.IPv6len)
+
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+
+			// return the error
+			return "", err
+
+		}
+		host = net.IP(ip).String()
+
+	case socksDomain:
+
+		// read the name
+		length, err := reader.ReadByte()
+		if err != nil {
+
+			// return the error
+			return "", err
+
+		}
+		name := make([]byte, length)
+		if _, err := io.ReadFull(reader, name); err != nil {
+
+			// return the error
+			return "", err
+
+		}
+		host = string(name)
+
+	default:
+
+		// it isn't an address we know
+		socksReply(conn, socksBadAddress)
+		return "", fmt.Errorf("socks address type %d is not supported", request[3])
+
+	}
+
+	// read the port
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+
+		// return the error
+		return "", err
+
+	}
+
+	// return the address
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+
+}
+
+// check the username and password a client sent
+func (server *socksServer) login(conn net.Conn, reader *bufio.Reader) error {
+
+	// read the version
+	version, err := reader.ReadByte()
+	if (err != nil) || (version != socksAuthVersion) {
+
+		// it is wrong
+		return errors.New("bad login version")
+
+	}
+
+	// read the username and password
+	fields := []string{}
+	for x := 0; x < 2; x++ {
+
+		// read the length
+		length, err := reader.ReadByte()
+		if err != nil {
+
+			// return the error
+			return err
+
+		}
+
+		// read the field
+		field := make([]byte, length)
+		if _, err := io.ReadFull(reader, field); err != nil {
+
+			// return the error
+			return err
+
+		}
+		fields = append(fields, string(field))
+
+	}
+
+	// check them
+	userOK := subtle.ConstantTimeCompare([]byte(fields[0]), []byte(server.user)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(fields[1]), []byte(server.password)) == 1
+	if !userOK || !passwordOK {
+
+		// they are wrong
+		conn.Write([]byte{socksAuthVersion, socksFailure})
+		return fmt.Errorf("wrong username or password for %s", fields[0])
+
+	}
+
+	// they are right
+	_, err = conn.Write([]byte{socksAuthVersion, socksSucceeded})
+	return err
+
+}
@@ -0,0 +1,103 @@
+/*
+
+maryo/socks_test.go
+
+tests for the socks5 handshake
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+// the handshake reads the address to connect to, logs the client in
+// if it has to, and answers the client the way rfc 1928 and 1929 say
+func TestSOCKSHandshake(t *testing.T) {
+
+	// replies the server can send
+	noAuth := []byte{socksVersion, socksNoAuth}
+	userPass := []byte{socksVersion, socksUserPass}
+	noMethods := []byte{socksVersion, socksNoMethods}
+	loggedIn := []byte{socksAuthVersion, socksSucceeded}
+	loginFailed := []byte{socksAuthVersion, socksFailure}
+	badCommand := []byte{socksVersion, socksBadCommand, 0, socksIPv4, 0, 0, 0, 0, 0, 0}
+	badAddress := []byte{socksVersion, socksBadAddress, 0, socksIPv4, 0, 0, 0, 0, 0, 0}
+
+	// put bytes together
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	// parts of what the client sends
+	greeting := []byte{socksVersion, 1, socksNoAuth}
+	greetingLogin := []byte{socksVersion, 2, socksNoAuth, socksUserPass}
+	domain := join([]byte{socksVersion, socksConnect, 0, socksDomain, 20}, []byte("account.nintendo.net"), []byte{1, 0xbb})
+	login := func(user string, password string) []byte {
+		return join([]byte{socksAuthVersion, byte(len(user))}, []byte(user), []byte{byte(len(password))}, []byte(password))
+	}
+
+	// each client, and what the server should do with it
+	tests := []struct {
+		name    string
+		user    string
+		sent    []byte
+		target  string
+		replies []byte
+	}{
+		{"domain", "", join(greeting, domain), "account.nintendo.net:443", noAuth},
+		{"ipv4", "", join(greeting, []byte{socksVersion, socksConnect, 0, socksIPv4, 127, 0, 0, 1, 0, 80}), "127.0.0.1:80", noAuth},
+		{"ipv6", "", join(greeting, []byte{socksVersion, socksConnect, 0, socksIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1f, 0x90}), "[::1]:8080", noAuth},
+		{"login", "user", join(greetingLogin, login("user", "password"), domain), "account.nintendo.net:443", join(userPass, loggedIn)},
+		{"wrong password", "user", join(greetingLogin, login("user", "nope"), domain), "", join(userPass, loginFailed)},
+		{"wrong user", "user", join(greetingLogin, login("resu", "password"), domain), "", join(userPass, loginFailed)},
+		{"empty login", "user", join(greetingLogin, login("", ""), domain), "", join(userPass, loginFailed)},
+		{"bad login version", "user", join(greetingLogin, []byte{5, 4}, []byte("user"), []byte{8}, []byte("password")), "", userPass},
+		{"no login offered", "user", join(greeting, domain), "", noMethods},
+		{"no methods offered", "", join([]byte{socksVersion, 0}, domain), "", noMethods},
+		{"socks4", "", []byte{4, socksConnect, 0, 80, 127, 0, 0, 1, 0}, "", nil},
+		{"bind", "", join(greeting, []byte{socksVersion, 2, 0, socksIPv4, 127, 0, 0, 1, 0, 80}), "", join(noAuth, badCommand)},
+		{"udp", "", join(greeting, []byte{socksVersion, 3, 0, socksIPv4, 127, 0, 0, 1, 0, 80}), "", join(noAuth, badCommand)},
+		{"unknown address type", "", join(greeting, []byte{socksVersion, socksConnect, 0, 2, 127, 0, 0, 1, 0, 80}), "", join(noAuth, badAddress)},
+		{"cut off greeting", "", []byte{socksVersion}, "", nil},
+		{"cut off request", "", join(greeting, domain[:10]), "", noAuth},
+		{"no port", "", join(greeting, domain[:len(domain)-2]), "", noAuth},
+	}
+
+	// check each of them
+	for _, test := range tests {
+
+		// do the handshake, keeping the replies
+		conn := &recordConn{}
+		server := &socksServer{user: test.user, password: "password"}
+		target, err := server.handshake(conn, bufio.NewReader(bytes.NewReader(test.sent)))
+		replies := conn.written.Bytes()
+
+		// check them
+		if (test.target != "") && ((err != nil) || (target != test.target)) {
+
+			// it should have worked
+			t.Fatalf("%s: expected %q, got %q and %v", test.name, test.target, target, err)
+
+		}
+		if (test.target == "") && (err == nil) {
+
+			// it shouldn't have
+			t.Fatalf("%s: expected an error, got %q", test.name, target)
+
+		}
+		if !bytes.Equal(replies, test.replies) {
+
+			// the client was told the wrong thing
+			t.Fatalf("%s: expected the replies %v, got %v", test.name, test.replies, replies)
+
+		}
+
+	}
+
+}
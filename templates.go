@@ -0,0 +1,416 @@
+/*
+
+maryo/templates.go
+
+config templates, both the builtin ones and the ones
+in maryo-data/templates
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// where user templates are kept
+const templateDir = "maryo-data/templates"
+
+// load all of the templates, builtin ones first.
+// user templates with the same name as a builtin one replace it
+func loadTemplates() []templateStruct {
+
+	// list of templates
+	templates := []templateStruct{}
+
+	// index of each template in the list by name
+	index := make(map[string]int)
+
+	// add a template to the list
+	add := func(tmpl templateStruct) {
+
+		// replace it if it is already there
+		if x, isItIn := index[tmpl.Name]; isItIn {
+
+			// replace it
+			templates[x] = tmpl
+			return
+
+		}
+
+		// otherwise add it
+		index[tmpl.Name] = len(templates)
+		templates = append(templates, tmpl)
+
+	}
+
+	// load the builtin templates, which are in order by name
+	builtin, err := builtinTemplates.ReadDir("templates")
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: the builtin templates couldn't be read. (report this issue)\n")
+
+		// show traceback
+		panic(err)
+
+	}
+	for _, file := range builtin {
+
+		// read it
+		data, err := builtinTemplates.ReadFile(strings.Join([]string{"templates/", file.Name()}, ""))
+		if err != nil {
+
+			// show an error message
+			fmt.Printf("[err]: the builtin template %s couldn't be read. (report this issue)\n", file.Name())
+
+			// show traceback
+			panic(err)
+
+		}
+
+		// parse it
+		var tmpl templateStruct
+		err = json.Unmarshal(data, &tmpl)
+
+		// handle errors
+		if err != nil {
+
+			// show an error message
+			fmt.Printf("[err]: a builtin template is invalid JSON. (report this issue)\n")
+
+			// show traceback
+			panic(err)
+
+		}
+
+		// add it
+		add(tmpl)
+
+	}
+
+	// there may not be any user templates
+	if doesDirExist(templateDir) == false {
+
+		// just return the builtin ones
+		return templates
+
+	}
+
+	// list the template files
+	files, err := ioutil.ReadDir(templateDir)
+
+	// handle errors
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: error while listing %s\n", templateDir)
+		fmt.Printf("       %s\n", err.Error())
+
+		// just return the builtin ones
+		return templates
+
+	}
+
+	// sort them so the order is the same every time
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	// load each of them
+	for _, file := range files {
+
+		// only look at json files
+		if file.IsDir() || (filepath.Ext(file.Name()) != ".json") {
+
+			// skip it
+			continue
+
+		}
+
+		// parse it
+		var tmpl templateStruct
+		err := json.Unmarshal(readFileByte(filepath.Join(templateDir, file.Name())), &tmpl)
+
+		// handle errors
+		if err != nil {
+
+			// skip the broken template
+			fmt.Printf("[err]: the template %s is invalid JSON, skipping it...\n", file.Name())
+			continue
+
+		}
+
+		// name it after the file if it has no name
+		if tmpl.Name == "" {
+
+			// strip the extension
+			tmpl.Name = strings.TrimSuffix(file.Name(), ".json")
+
+		}
+
+		// add it
+		add(tmpl)
+
+	}
+
+	// return the templates
+	return templates
+
+}
+
+// find a template by its name
+func findTemplate(name string) (templateStruct, bool) {
+
+	// look through all of them
+	for _, tmpl := range loadTemplates() {
+
+		// check the name
+		if tmpl.Name == name {
+
+			// found it
+			return tmpl, true
+
+		}
+
+	}
+
+	// no template with that name
+	return templateStruct{}, false
+
+}
+
+// get the names of all of the templates
+func templateNames() []string {
+
+	// list of names
+	names := []string{}
+
+	// add each of them
+	for _, tmpl := range loadTemplates() {
+
+		// add the name
+		names = append(names, tmpl.Name)
+
+	}
+
+	// return the names
+	return names
+
+}
+
+// turn a template into a config
+func (tmpl templateStruct) config() map[string]map[string]interface{} {
+
+	// make a map for the config
+	config := make(map[string]map[string]interface{})
+	config["endpoints"] = make(map[string]interface{})
+	config["config"] = make(map[string]interface{})
+
+	// copy the endpoints
+	for from, to := range tmpl.Endpoints {
+
+		// set it in the config
+		config["endpoints"][from] = to
+
+	}
+
+	// copy the settings
+	for key, value := range tmpl.Settings {
+
+		// set it in the config
+		config["config"][key] = value
+
+	}
+
+	// return the config
+	return config
+
+}
+
+// get a config by its template name
+func templateConfig(name string) (map[string]map[string]interface{}, bool) {
+
+	// find the template
+	tmpl, ok := findTemplate(name)
+
+	// no template with that name
+	if ok == false {
+
+		// return nothing
+		return nil, false
+
+	}
+
+	// return it as a config
+	return tmpl.config(), true
+
+}
+
+// template subcommand
+func templateCommand(args []string) {
+
+	// make sure there is an action
+	if len(args) == 0 {
+
+		// show the usage
+		fmt.Printf("usage: maryo template list\n")
+		fmt.Printf("       maryo template export --name <name> [--description <text>] [--config <path>]\n")
+		os.Exit(1)
+
+	}
+
+	// do the action
+	switch args[0] {
+
+	case "list":
+
+		// show each template
+		for _, tmpl := range loadTemplates() {
+
+			// show the name and description
+			consoleSequence(fmt.Sprintf("%s%s%s - %s\n", code("green"), tmpl.Name, code("reset"), tmpl.Description))
+
+			// and the endpoints
+			for from, to := range tmpl.Endpoints {
+
+				// show it
+				fmt.Printf("  %s -> %s\n", from, to)
+
+			}
+
+		}
+
+	case "export":
+
+		// export the current config as a template
+		exportTemplate(args[1:])
+
+	default:
+
+		// show an error message
+		fmt.Printf("[err]: %s is not a template action...\n", args[0])
+		fmt.Printf("       please use list or export\n")
+		os.Exit(1)
+
+	}
+
+}
+
+// export the current config as a new template
+func exportTemplate(args []string) {
+
+	// flags for exporting
+	flags := flag.NewFlagSet("template export", flag.ExitOnError)
+	configPath := flags.String("config", "maryo-data/config.json", "path of the config to export")
+	name := flags.String("name", "", "name of the new template")
+	description := flags.String("description", "", "description of the new template")
+	force := flags.Bool("force", false, "if set, an existing template with the same name is replaced")
+	flags.Parse(args)
+
+	// make sure it has a usable name
+	if (*name == "") || strings.ContainsAny(*name, "/\\.") {
+
+		// show an error message
+		fmt.Printf("[err]: please give the template a --name without slashes or dots...\n")
+		os.Exit(1)
+
+	}
+
+	// make sure the config is there
+	if !doesFileExist(*configPath) || !checkJSONValidity(*configPath) {
+
+		// show an error message
+		fmt.Printf("[err]: there is no valid config at %s...\n", *configPath)
+		os.Exit(1)
+
+	}
+
+	// load the config
+	configData := readJSONFile(*configPath)
+
+	// build the template
+	tmpl := templateStruct{
+
+		Name:        *name,
+		Description: *description,
+		Endpoints:   make(map[string]string),
+		Settings:    make(map[string]interface{}),
+	}
+
+	// copy the endpoints
+	if endpoints, ok := configData["endpoints"].(map[string]interface{}); ok {
+
+		// copy each of them
+		for from, to := range endpoints {
+
+			// set it in the template
+			tmpl.Endpoints[from] = fmt.Sprintf("%v", to)
+
+		}
+
+	}
+
+	// copy the settings
+	if settings, ok := configData["config"].(map[string]interface{}); ok {
+
+		// copy each of them
+		for key, value := range settings {
+
+			// set it in the template
+			tmpl.Settings[key] = value
+
+		}
+
+	}
+
+	// where it goes
+	file := filepath.Join(templateDir, strings.Join([]string{*name, ".json"}, ""))
+
+	// don't replace one by accident
+	if doesFileExist(file) && (*force == false) {
+
+		// show an error message
+		fmt.Printf("[err]: the template %s already exists, pass --force to replace it...\n", *name)
+		os.Exit(1)
+
+	}
+
+	// prettify the JSON
+	data, err := json.MarshalIndent(tmpl, "", "    ")
+
+	// error handling
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: error while prettifying JSON\n")
+
+		// show traceback
+		panic(err)
+
+	}
+
+	// make sure the template folder exists
+	if doesDirExist(templateDir) == false {
+
+		// make it
+		makeDirectory(templateDir)
+
+	}
+
+	// write it
+	writeByteToFile(file, data)
+
+	// let the user know
+	fmt.Printf("saved the template %s to %s...\n", *name, file)
+
+}
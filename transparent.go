@@ -0,0 +1,240 @@
+/*
+
+maryo/transparent.go
+
+listens on the http and https ports for consoles that were
+pointed at maryo with dns or redirected to it with iptables, and
+works out where each connection was meant to go from its sni or
+host header
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// the first byte of a tls handshake record
+const tlsHandshakeRecord = 0x16
+
+// how long a client has to say where it is going
+const transparentPeekMax = 30 * time.Second
+
+// metrics for the transparent listeners
+var transparentConnections = newCounter("maryo_transparent_connections_total", "connections made to the transparent listeners")
+
+// used to stop the handshake once the client hello is read
+var errGotHello = errors.New("got the client hello")
+
+// start the transparent http and https listeners
+func startTransparent(configData map[string]interface{}, proxy http.Handler, access *accessControl) {
+
+	// listen on both
+	for _, port := range []string{getSetting(configData, "transparentHTTPPort", "80"), getSetting(configData, "transparentHTTPSPort", "443")} {
+
+		// listen
+		listener, err := net.Listen("tcp", strings.Join([]string{":", port}, ""))
+		if err != nil {
+
+			// show an error message
+			fmt.Printf("[err]: couldn't start the transparent listener on port %s: %s\n", port, err.Error())
+			continue
+
+		}
+
+		// stop it with the proxy
+		currentSession.closeOnShutdown(func() { listener.Close() })
+
+		// and only take allowed clients
+		listener = access.listener(listener)
+
+		// let the user know
+		consoleSequence(fmt.Sprintf("-> hosting transparent listener on %s:%s%s\n", code("green"), port, code("reset")))
+		writeLog(fmt.Sprintf("-> hosting transparent listener on port :%s\n", port))
+
+		// accept connections
+		go func(listener net.Listener) {
+
+			// forever
+			for {
+
+				// accept one
+				conn, err := listener.Accept()
+				if err != nil {
+
+					// stop if it was closed
+					if errors.Is(err, net.ErrClosed) {
+
+						// it was
+						return
+
+					}
+
+					// show an error message
+					fmt.Printf("[err]: error while accepting a transparent connection: %s\n", err.Error())
+					continue
+
+				}
+
+				// handle it
+				go serveTransparent(proxy, conn)
+
+			}
+
+		}(listener)
+
+	}
+
+}
+
+// work out where a connection was going, and give it to the proxy.
+// both kinds are accepted on either port
+func serveTransparent(proxy http.Handler, conn net.Conn) {
+
+	// count it
+	transparentConnections.add(1)
+
+	// don't wait forever for the client to say something
+	conn.SetDeadline(time.Now().Add(transparentPeekMax))
+
+	// look at the first byte
+	reader := bufio.NewReaderSize(conn, 5+16384)
+	first, err := reader.Peek(1)
+	if err != nil {
+
+		// it went away
+		conn.Close()
+		return
+
+	}
+
+	// connections redirected with iptables still know where they were going
+	redirected := ""
+	if original, err := originalDestination(conn); (err == nil) && (original != conn.LocalAddr().String()) {
+
+		// keep it
+		redirected = original
+
+	}
+
+	// plain http has a host header
+	if first[0] != tlsHandshakeRecord {
+
+		// serve it, sending requests without one where they were going
+		conn.SetDeadline(time.Time{})
+		interceptHTTP(proxy, &bufferedConn{Conn: conn, reader: reader}, redirected)
+		return
+
+	}
+
+	// tls has the name in the client hello
+	name, err := peekServerName(reader)
+	conn.SetDeadline(time.Time{})
+
+	// keep the port it was going to
+	port := "443"
+	if redirected != "" {
+
+		// use that one
+		_, port, _ = net.SplitHostPort(redirected)
+
+	}
+	target := net.JoinHostPort(name, port)
+	if err != nil {
+
+		// use the address it was going to, if we know it
+		if redirected == "" {
+
+			// we don't
+			fmt.Printf("[err]: couldn't tell where the connection from %s was going: %s\n", conn.RemoteAddr().String(), err.Error())
+			conn.Close()
+			return
+
+		}
+		target = redirected
+
+	}
+
+	// give it to the proxy as a CONNECT. there's nobody to answer
+	interceptConnect(proxy, &bufferedConn{Conn: conn, reader: reader}, target)
+
+}
+
+// a connection that reads from a buffer and ignores writes, so
+// the tls package can read a client hello without answering it
+type helloConn struct {
+	net.Conn
+	reader *bytes.Reader
+}
+
+// read from the buffer
+func (conn *helloConn) Read(data []byte) (int, error) {
+
+	// read it
+	return conn.reader.Read(data)
+
+}
+
+// throw away what is written
+func (conn *helloConn) Write(data []byte) (int, error) {
+
+	// it's all written
+	return len(data), nil
+
+}
+
+// get the server name from the client hello at the start of the reader,
+// without reading it
+func peekServerName(reader *bufio.Reader) (string, error) {
+
+	// get the length of the first record
+	header, err := reader.Peek(5)
+	if err != nil {
+
+		// return the error
+		return "", err
+
+	}
+	record, err := reader.Peek(5 + (int(header[3])<<8 | int(header[4])))
+	if err != nil {
+
+		// return the error
+		return "", err
+
+	}
+
+	// have the tls package read it
+	name := ""
+	tls.Server(&helloConn{reader: bytes.NewReader(record)}, &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+
+		// keep the name
+		name = hello.ServerName
+		return nil, errGotHello
+
+	}}).Handshake()
+
+	// there might not be one
+	if name == "" {
+
+		// there isn't
+		return "", errors.New("the client didn't send a server name")
+
+	}
+
+	// return it
+	return name, nil
+
+}
@@ -0,0 +1,109 @@
+/*
+
+maryo/transparent_test.go
+
+tests for reading the server name from a tls client hello
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+// a connection that keeps what is written to it, and has nothing to read
+type recordConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+// keep what is written
+func (conn *recordConn) Write(data []byte) (int, error) {
+
+	// keep it
+	return conn.written.Write(data)
+
+}
+
+// there is never anything to read
+func (conn *recordConn) Read(data []byte) (int, error) {
+
+	// nothing
+	return 0, io.EOF
+
+}
+
+// get the client hello a tls client sends for a server name
+func clientHello(name string) []byte {
+
+	// start a handshake that can't go anywhere
+	conn := &recordConn{}
+	tls.Client(conn, &tls.Config{ServerName: name, InsecureSkipVerify: true}).Handshake()
+
+	// return what it sent
+	return conn.written.Bytes()
+
+}
+
+// the server name is read without using up the client hello
+func TestPeekServerName(t *testing.T) {
+
+	// each stream, and the name that should be read from it
+	hello := clientHello("account.nintendo.net")
+	tests := []struct {
+		name   string
+		stream []byte
+		want   string
+	}{
+		{"a name", hello, "account.nintendo.net"},
+		{"a name, then more", append(append([]byte{}, hello...), "after"...), "account.nintendo.net"},
+		{"no name", clientHello(""), ""},
+		{"an ip isn't sent as a name", clientHello("127.0.0.1"), ""},
+		{"cut off", hello[:len(hello)-1], ""},
+		{"only the header", hello[:5], ""},
+		{"too short for a header", hello[:3], ""},
+		{"not tls", []byte("GET / HTTP/1.1\r\nHost: nintendo.net\r\n\r\n"), ""},
+		{"nothing", []byte{}, ""},
+	}
+
+	// check each of them
+	for _, test := range tests {
+
+		// read the name
+		reader := bufio.NewReaderSize(bytes.NewReader(test.stream), 16*1024)
+		name, err := peekServerName(reader)
+		if (test.want != "") && ((err != nil) || (name != test.want)) {
+
+			// it should have been read
+			t.Fatalf("%s: expected %q, got %q and %v", test.name, test.want, name, err)
+
+		}
+		if (test.want == "") && (err == nil) {
+
+			// it shouldn't have
+			t.Fatalf("%s: expected an error, got %q", test.name, name)
+
+		}
+
+		// everything is still there to be read
+		rest, _ := io.ReadAll(reader)
+		if !bytes.Equal(rest, test.stream) {
+
+			// something was used up
+			t.Fatalf("%s: %d of %d bytes are left to read after peeking", test.name, len(rest), len(test.stream))
+
+		}
+
+	}
+
+}
@@ -0,0 +1,553 @@
+/*
+
+maryo/upgrade.go
+
+passes websockets and other upgraded connections through,
+and makes sure streamed responses aren't held back
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long a connection can sit without anything being sent on it
+// before it is closed, set from the config
+var idleTimeout = 5 * time.Minute
+
+// how much of a websocket frame is shown in the log
+const framePreviewMax = 80
+
+// websocket frames bigger than this aren't kept around to be shown
+const frameBufferMax = 64 * 1024
+
+// the names of websocket opcodes
+var frameOpcodes = map[byte]string{
+	0:  "continuation",
+	1:  "text",
+	2:  "binary",
+	8:  "close",
+	9:  "ping",
+	10: "pong",
+}
+
+// metrics for upgraded connections
+var upgradedConnections = newCounter("maryo_upgrades_total", "connections upgraded to another protocol, like websockets")
+
+// sends upgrade requests through maryo itself, since goproxy drops
+// the headers they need, and everything else to goproxy
+type upgradeHandler struct {
+	proxy     http.Handler
+	route     func(r *http.Request) *http.Response
+	upstream  *upstreams
+	logFrames bool
+}
+
+// make the handler from the settings in the config. route blocks,
+// logs, and redirects a request like the proxy does
+func upgradeHandlerFromConfig(configData map[string]interface{}, proxy http.Handler, route func(r *http.Request) *http.Response, upstream *upstreams) *upgradeHandler {
+
+	// get the idle timeout
+	timeout, err := time.ParseDuration(getSetting(configData, "idleTimeout", "5m"))
+	if (err != nil) || (timeout < 0) {
+
+		// use the default
+		fmt.Printf("[err]: idleTimeout must be a duration like 90s or 5m (or 0 to never time out), using 5m\n")
+		timeout = 5 * time.Minute
+
+	}
+	idleTimeout = timeout
+
+	// make it
+	return &upgradeHandler{
+
+		proxy:     proxy,
+		route:     route,
+		upstream:  upstream,
+		logFrames: getSetting(configData, "logFrames", "false") == "true",
+	}
+
+}
+
+// check if a header has a token in its comma separated list
+func headerHasToken(header http.Header, name string, token string) bool {
+
+	// check each value
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+
+		// and each token in it
+		for _, part := range strings.Split(value, ",") {
+
+			// check it
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+
+				// it has it
+				return true
+
+			}
+
+		}
+
+	}
+
+	// it doesn't
+	return false
+
+}
+
+// check if a request asks to upgrade the connection
+func isUpgrade(r *http.Request) bool {
+
+	// it needs both headers
+	return headerHasToken(r.Header, "Connection", "upgrade") && (r.Header.Get("Upgrade") != "")
+
+}
+
+// a response writer that sends everything right away, so streamed
+// responses reach the console as they come in
+type flushWriter struct {
+	http.ResponseWriter
+}
+
+// write and flush
+func (w *flushWriter) Write(data []byte) (int, error) {
+
+	// write it
+	n, err := w.ResponseWriter.Write(data)
+
+	// and send it
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+
+		// flush it
+		flusher.Flush()
+
+	}
+
+	// return the result
+	return n, err
+
+}
+
+// handle a request
+func (h *upgradeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	// goproxy needs the connection itself for connects
+	if r.Method == "CONNECT" {
+
+		// give it as is
+		h.proxy.ServeHTTP(w, r)
+		return
+
+	}
+
+	// let it finish if the proxy is stopped
+	defer currentSession.begin()()
+
+	// upgrades are handled here
+	if r.URL.IsAbs() && isUpgrade(r) {
+
+		// handle it
+		h.upgrade(w, r)
+		return
+
+	}
+
+	// everything else goes to goproxy, flushed as it goes
+	h.proxy.ServeHTTP(&flushWriter{w}, r)
+
+}
+
+// send a response that didn't upgrade the connection
+func writeResponse(w http.ResponseWriter, resp *http.Response) {
+
+	// send the headers
+	defer resp.Body.Close()
+	for name, values := range resp.Header {
+
+		// copy them
+		w.Header()[name] = values
+
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	// and the body
+	io.Copy(&flushWriter{w}, resp.Body)
+
+}
+
+// send an upgrade request upstream, and connect the two if it works
+func (h *upgradeHandler) upgrade(w http.ResponseWriter, r *http.Request) {
+
+	// block, log, and redirect it
+	host := r.URL.Host
+	protocol := r.Header.Get("Upgrade")
+	if resp := h.route(r); resp != nil {
+
+		// it was blocked
+		writeResponse(w, resp)
+		return
+
+	}
+
+	// get it ready to send on. the connection and upgrade headers stay,
+	// and it has to be http/1.1 to be upgraded
+	transport := h.upstream.http1Transport(host)
+	r.RequestURI = ""
+	r.Header.Del("Proxy-Connection")
+	r.Header.Del("Proxy-Authorization")
+
+	// send it
+	resp, err := h.upstream.sendWith(host, transport, r)
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: error while upgrading the connection to %s: %s\n", host, err.Error())
+		writeResponse(w, upstreamErrorResponse(r, err))
+		return
+
+	}
+
+	// the server might not want to
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+
+		// send its answer
+		writeResponse(w, resp)
+		return
+
+	}
+	server, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+
+		// this shouldn't happen
+		resp.Body.Close()
+		http.Error(w, "no worries, this is an error in maryo\nthe upgraded connection can't be written to", http.StatusBadGateway)
+		return
+
+	}
+
+	// take over the console's connection
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+
+		// this shouldn't happen either
+		server.Close()
+		http.Error(w, "no worries, this is an error in maryo\nthe connection can't be taken over", http.StatusInternalServerError)
+		return
+
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+
+		// show an error message
+		fmt.Printf("[err]: error while taking over the connection for %s: %s\n", host, err.Error())
+		server.Close()
+		return
+
+	}
+
+	// pass on the server's answer
+	fmt.Fprintf(client, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(client)
+	io.WriteString(client, "\r\n")
+
+	// let the user know
+	upgradedConnections.add(1)
+	consoleSequence(fmt.Sprintf("-> upgraded the connection to %s%s%s to %s\n", code("green"), host, code("reset"), protocol))
+	writeLog(fmt.Sprintf("-> upgraded the connection to %s to %s\n", host, protocol))
+
+	// connect them
+	h.relay(client, buffered.Reader, server, host, strings.EqualFold(protocol, "websocket"))
+
+}
+
+// copy between the console and the server until one side closes,
+// or nothing is sent for the idle timeout
+func (h *upgradeHandler) relay(client net.Conn, clientReader io.Reader, server io.ReadWriteCloser, host string, websocket bool) {
+
+	// close both sides at once
+	var once sync.Once
+	closeBoth := func() {
+
+		// close them
+		once.Do(func() {
+
+			// close them
+			client.Close()
+			server.Close()
+
+		})
+
+	}
+
+	// and when the proxy stops
+	defer currentSession.closeOnShutdown(closeBoth)()
+
+	// close them if they sit for too long
+	var timer *time.Timer
+	if idleTimeout > 0 {
+
+		// start the timer
+		timer = time.AfterFunc(idleTimeout, closeBoth)
+
+	}
+
+	// copy one way
+	copyOneWay := func(dst io.Writer, src io.Reader, direction string, total *int64, done *sync.WaitGroup) {
+
+		// it is done when this returns
+		defer done.Done()
+		defer closeBoth()
+
+		// log the frames if asked to
+		var frames *frameLogger
+		if h.logFrames && websocket {
+
+			// make the logger
+			frames = &frameLogger{direction: direction, host: host}
+
+		}
+
+		// copy it
+		buf := make([]byte, 32*1024)
+		for {
+
+			// read some
+			n, err := src.Read(buf)
+			if n > 0 {
+
+				// it isn't idle
+				if timer != nil {
+
+					// reset the timer
+					timer.Reset(idleTimeout)
+
+				}
+
+				// log it
+				if frames != nil {
+
+					// log the frames in it
+					frames.Write(buf[:n])
+
+				}
+
+				// send it
+				if _, err := dst.Write(buf[:n]); err != nil {
+
+					// the other side is gone
+					return
+
+				}
+				*total += int64(n)
+
+			}
+			if err != nil {
+
+				// this side is done
+				return
+
+			}
+
+		}
+
+	}
+
+	// copy both ways
+	var sent, received int64
+	var done sync.WaitGroup
+	done.Add(2)
+	go copyOneWay(server, clientReader, "console -> server", &sent, &done)
+	go copyOneWay(client, server, "server -> console", &received, &done)
+	done.Wait()
+	if timer != nil {
+
+		// it is done
+		timer.Stop()
+
+	}
+
+	// let the user know
+	consoleSequence(fmt.Sprintf("-> closed the upgraded connection to %s%s%s (%d bytes sent, %d received)\n", code("green"), host, code("reset"), sent, received))
+	writeLog(fmt.Sprintf("-> closed the upgraded connection to %s (%d bytes sent, %d received)\n", host, sent, received))
+
+}
+
+// logs the websocket frames in a stream, as it goes by
+type frameLogger struct {
+	direction string
+	host      string
+	pending   []byte
+	skip      uint64
+}
+
+// read frames from part of the stream. it never fails
+func (logger *frameLogger) Write(data []byte) (int, error) {
+
+	// it all gets written
+	written := len(data)
+
+	// skip the rest of a frame that was too big to keep
+	if logger.skip > 0 {
+
+		// skip what we can
+		n := uint64(len(data))
+		if n > logger.skip {
+
+			// only the rest of the frame
+			n = logger.skip
+
+		}
+		logger.skip -= n
+		data = data[n:]
+
+	}
+
+	// log the frames
+	logger.pending = append(logger.pending, data...)
+	for logger.frame() {
+	}
+
+	// it's all written
+	return written, nil
+
+}
+
+// log the frame at the start of pending, if it is all there
+func (logger *frameLogger) frame() bool {
+
+	// read the header
+	if len(logger.pending) < 2 {
+
+		// it isn't all there
+		return false
+
+	}
+	opcode := logger.pending[0] & 0x0f
+	masked := logger.pending[1]&0x80 != 0
+	length := uint64(logger.pending[1] & 0x7f)
+	offset := 2
+	switch length {
+
+	case 126:
+
+		// a two byte length
+		if len(logger.pending) < 4 {
+
+			// it isn't all there
+			return false
+
+		}
+		length = uint64(binary.BigEndian.Uint16(logger.pending[2:4]))
+		offset = 4
+
+	case 127:
+
+		// an eight byte length
+		if len(logger.pending) < 10 {
+
+			// it isn't all there
+			return false
+
+		}
+		length = binary.BigEndian.Uint64(logger.pending[2:10])
+		offset = 10
+
+	}
+	var mask []byte
+	if masked {
+
+		// the mask comes after the length
+		if len(logger.pending) < offset+4 {
+
+			// it isn't all there
+			return false
+
+		}
+		mask = logger.pending[offset : offset+4]
+		offset += 4
+
+	}
+
+	// describe the frame
+	name, ok := frameOpcodes[opcode]
+	if !ok {
+
+		// it is one we don't know
+		name = fmt.Sprintf("opcode %d", opcode)
+
+	}
+	available := uint64(len(logger.pending) - offset)
+
+	// wait for the rest of it, unless it is too big to keep
+	if (available < length) && (length <= frameBufferMax) {
+
+		// wait
+		return false
+
+	}
+
+	// show the start of text frames
+	preview := ""
+	if opcode == 1 {
+
+		// unmask what we have of it
+		shown := length
+		if shown > available {
+
+			// only what is here
+			shown = available
+
+		}
+		if shown > framePreviewMax {
+
+			// only the start
+			shown = framePreviewMax
+
+		}
+		text := make([]byte, shown)
+		for x := range text {
+
+			// unmask it
+			text[x] = logger.pending[offset+x]
+			if mask != nil {
+
+				// with the byte of the mask for it
+				text[x] ^= mask[x%4]
+
+			}
+
+		}
+		preview = fmt.Sprintf(": %q", text)
+
+	}
+
+	// log it
+	consoleSequence(fmt.Sprintf("-> websocket %s %s%s%s: %s frame, %d bytes%s\n", logger.direction, code("grey"), logger.host, code("reset"), name, length, preview))
+	writeLog(fmt.Sprintf("-> websocket %s %s: %s frame, %d bytes%s\n", logger.direction, logger.host, name, length, preview))
+
+	// move on to the next one
+	if available < length {
+
+		// skip the rest of this one as it comes in
+		logger.skip = length - available
+		logger.pending = nil
+		return false
+
+	}
+	logger.pending = logger.pending[uint64(offset)+length:]
+	return true
+
+}
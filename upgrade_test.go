@@ -0,0 +1,192 @@
+/*
+
+maryo/upgrade_test.go
+
+tests for the websocket frame logger
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// make a websocket frame, masking it if there is a mask
+func wsFrame(opcode byte, payload []byte, mask []byte) []byte {
+
+	// the first byte is fin and the opcode
+	frame := []byte{0x80 | opcode}
+
+	// then the length, in however many bytes it needs
+	maskBit := byte(0)
+	if mask != nil {
+
+		// it is masked
+		maskBit = 0x80
+
+	}
+	switch {
+
+	case len(payload) < 126:
+
+		// it fits in the first one
+		frame = append(frame, maskBit|byte(len(payload)))
+
+	case len(payload) <= 0xffff:
+
+		// two bytes
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+
+	default:
+
+		// eight bytes
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+
+	}
+
+	// then the payload
+	if mask == nil {
+
+		// as it is
+		return append(frame, payload...)
+
+	}
+	frame = append(frame, mask...)
+	for x, b := range payload {
+
+		// masked
+		frame = append(frame, b^mask[x%4])
+
+	}
+	return frame
+
+}
+
+// split data into pieces of a size
+func chunks(data []byte, size int) [][]byte {
+
+	// split it
+	pieces := [][]byte{}
+	for len(data) > size {
+
+		// take a piece
+		pieces = append(pieces, data[:size])
+		data = data[size:]
+
+	}
+
+	// and the rest
+	return append(pieces, data)
+
+}
+
+// the frame logger logs every frame once, however the stream is split up
+func TestFrameLogger(t *testing.T) {
+
+	// some frames
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	hello := wsFrame(1, []byte("hello"), nil)
+	maskedHello := wsFrame(1, []byte("hello"), mask)
+	long := wsFrame(1, bytes.Repeat([]byte("a"), 100), nil)
+	medium := wsFrame(2, make([]byte, 200), mask)
+	huge := wsFrame(2, make([]byte, frameBufferMax+1000), nil)
+	closing := wsFrame(8, nil, nil)
+
+	// each stream, and what should be logged for it
+	tests := []struct {
+		name   string
+		writes [][]byte
+		lines  []string
+	}{
+		{"text", [][]byte{hello}, []string{`text frame, 5 bytes: "hello"`}},
+		{"masked text", [][]byte{maskedHello}, []string{`text frame, 5 bytes: "hello"`}},
+		{"a byte at a time", chunks(maskedHello, 1), []string{`text frame, 5 bytes: "hello"`}},
+		{"long text", [][]byte{long}, []string{fmt.Sprintf("text frame, 100 bytes: %q", strings.Repeat("a", framePreviewMax))}},
+		{"two byte length", chunks(medium, 7), []string{"binary frame, 200 bytes"}},
+		{"two in one write", [][]byte{append(wsFrame(9, nil, mask), wsFrame(10, nil, nil)...)}, []string{"ping frame, 0 bytes", "pong frame, 0 bytes"}},
+		{"unknown opcode", [][]byte{wsFrame(3, []byte("x"), nil)}, []string{"opcode 3 frame, 1 bytes"}},
+		{"too big to keep", append(chunks(huge, 4096), closing), []string{fmt.Sprintf("binary frame, %d bytes", frameBufferMax+1000), "close frame, 0 bytes"}},
+		{"too big, then one in the same write", [][]byte{huge[:5000], append(huge[5000:], hello...)}, []string{fmt.Sprintf("binary frame, %d bytes", frameBufferMax+1000), `text frame, 5 bytes: "hello"`}},
+		{"not all there", [][]byte{hello[:4]}, []string{}},
+		{"only the header", [][]byte{medium[:3]}, []string{}},
+	}
+
+	// check each of them
+	dir := t.TempDir()
+	for x, test := range tests {
+
+		// log to a file of its own
+		path := filepath.Join(dir, fmt.Sprintf("%d.log", x))
+		if err := currentLog.open(path); err != nil {
+
+			// it couldn't be opened
+			t.Fatalf("%s: error while opening the log: %v", test.name, err)
+
+		}
+
+		// write the stream
+		logger := &frameLogger{direction: "sent", host: "host"}
+		for _, data := range test.writes {
+
+			// write it
+			if n, err := logger.Write(data); (n != len(data)) || (err != nil) {
+
+				// it should take all of it
+				t.Fatalf("%s: wrote %d of %d bytes, with %v", test.name, n, len(data), err)
+
+			}
+
+		}
+		currentLog.Close()
+
+		// read what was logged
+		data, err := os.ReadFile(path)
+		if err != nil {
+
+			// it couldn't be read
+			t.Fatalf("%s: error while reading the log: %v", test.name, err)
+
+		}
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		if len(data) == 0 {
+
+			// nothing was
+			lines = []string{}
+
+		}
+
+		// check it
+		if len(lines) != len(test.lines) {
+
+			// it logged the wrong number of frames
+			t.Fatalf("%s: expected %d frames, got %q", test.name, len(test.lines), lines)
+
+		}
+		for y, line := range lines {
+
+			// check each line
+			if want := fmt.Sprintf("-> websocket sent host: %s", test.lines[y]); line != want {
+
+				// it is wrong
+				t.Fatalf("%s: expected %q, got %q", test.name, want, line)
+
+			}
+
+		}
+
+	}
+
+}
@@ -0,0 +1,401 @@
+/*
+
+maryo/upstream.go
+
+the connections maryo makes to the servers requests are
+sent to, which can be set up differently for each endpoint
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	// externals
+	"github.com/elazarl/goproxy"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// the transports used for each endpoint
+type upstreams struct {
+	base          *http.Transport
+	endpoints     map[string]*http.Transport
+	http2         bool
+	endpointHTTP2 map[string]bool
+	basePolicy    *callPolicy
+	policies      map[string]*callPolicy
+	breakers      map[string]*breaker
+	breakerLock   sync.Mutex
+	http1         map[*http.Transport]*http.Transport
+	http1Lock     sync.Mutex
+	configHosts   []string
+}
+
+// get the settings for an endpoint from the endpointConfig section
+func endpointSettings(configData map[string]interface{}, host string) map[string]interface{} {
+
+	// get the section
+	section, ok := configData["endpointConfig"].(map[string]interface{})
+	if !ok {
+
+		// there are none
+		return nil
+
+	}
+
+	// get the endpoint's settings, which can be for a pattern it matches
+	value, _ := lookupHost(section, host)
+	settings, _ := value.(map[string]interface{})
+
+	// return them
+	return settings
+
+}
+
+// get a setting for an endpoint from the endpointConfig section,
+// or a default value if it isn't set
+func getEndpointSetting(configData map[string]interface{}, host string, name string, def string) string {
+
+	// get the setting
+	switch value := endpointSettings(configData, host)[name].(type) {
+
+	case string:
+
+		// return it as is
+		return value
+
+	case bool, float64:
+
+		// format it
+		return fmt.Sprintf("%v", value)
+
+	}
+
+	// use the default
+	return def
+
+}
+
+// get a setting that is a list of strings for an endpoint
+func getEndpointListSetting(configData map[string]interface{}, host string, name string) []string {
+
+	// get the strings in it
+	return stringsOf(endpointSettings(configData, host)[name])
+
+}
+
+// get the hosts that have settings in the endpointConfig section
+func endpointConfigHosts(configData map[string]interface{}) []string {
+
+	// list of hosts
+	hosts := []string{}
+
+	// get the section
+	section, ok := configData["endpointConfig"].(map[string]interface{})
+	if !ok {
+
+		// there are none
+		return hosts
+
+	}
+
+	// add each of them
+	for host := range section {
+
+		// add it
+		hosts = append(hosts, host)
+
+	}
+
+	// return them
+	return hosts
+
+}
+
+// load the client certificate for an endpoint, if it has one
+func loadClientCert(configData map[string]interface{}, host string) (*tls.Certificate, error) {
+
+	// get the settings
+	certFile := getEndpointSetting(configData, host, "clientCert", "")
+	keyFile := getEndpointSetting(configData, host, "clientKey", "")
+	p12File := getEndpointSetting(configData, host, "clientPKCS12", "")
+
+	// pkcs#12 has both in one file
+	if p12File != "" {
+
+		// make sure it exists
+		if !doesFileExist(p12File) {
+
+			// it doesn't
+			return nil, fmt.Errorf("%s does not exist", p12File)
+
+		}
+
+		// decode it
+		key, cert, chain, err := pkcs12.DecodeChain(readFileByte(p12File), getEndpointSetting(configData, host, "clientPKCS12Password", ""))
+		if err != nil {
+
+			// return the error
+			return nil, err
+
+		}
+
+		// make the pair, with the chain after the cert
+		pair := &tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+		for _, ca := range chain {
+
+			// add it
+			pair.Certificate = append(pair.Certificate, ca.Raw)
+
+		}
+
+		// return it
+		return pair, nil
+
+	}
+
+	// there is no client cert
+	if (certFile == "") && (keyFile == "") {
+
+		// that's fine
+		return nil, nil
+
+	}
+
+	// both have to be there
+	if (certFile == "") || (keyFile == "") {
+
+		// one is missing
+		return nil, errors.New("clientCert and clientKey have to be used together")
+
+	}
+	if !doesFileExist(certFile) || !doesFileExist(keyFile) {
+
+		// one of them doesn't exist
+		return nil, fmt.Errorf("%s or %s does not exist", certFile, keyFile)
+
+	}
+
+	// try them as pem, which can have a chain
+	if pair, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+
+		// it worked
+		return &pair, nil
+
+	}
+
+	// then as der, or anything else the cert subcommand can read
+	cert, err := readCertFile(certFile)
+	if err != nil {
+
+		// return the error
+		return nil, err
+
+	}
+	key, err := readKeyFile(keyFile)
+	if err != nil {
+
+		// return the error
+		return nil, err
+
+	}
+
+	// make sure they go together
+	if !keyMatchesCert(key, cert) {
+
+		// they don't
+		return nil, errors.New("the client key does not belong to the client cert")
+
+	}
+
+	// return the pair
+	return &tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}, nil
+
+}
+
+// copy a transport, so it can be changed without changing the original
+func copyTransport(base *http.Transport) *http.Transport {
+
+	// copy it
+	transport := base.Clone()
+
+	// and its tls config, which might be shared
+	if transport.TLSClientConfig == nil {
+
+		// make one
+		transport.TLSClientConfig = &tls.Config{}
+
+	} else {
+
+		// copy it
+		transport.TLSClientConfig = transport.TLSClientConfig.Clone()
+
+	}
+
+	// return it
+	return transport
+
+}
+
+// make the transports for each endpoint. base is copied for
+// each of them, so anything set on it applies to all of them
+func upstreamsFromConfig(configData map[string]interface{}, base *http.Transport) (*upstreams, error) {
+
+	// get how every endpoint is checked
+	mode := getSetting(configData, "upstreamVerify", "")
+	bundle := getSetting(configData, "upstreamCABundle", "")
+	verifier, err := newUpstreamVerifier("", mode, bundle, nil)
+	if err != nil {
+
+		// return the error
+		return nil, fmt.Errorf("the upstream verify settings are wrong: %s", err.Error())
+
+	}
+
+	// make it, with the checks on the base
+	u := &upstreams{base: copyTransport(base), endpoints: make(map[string]*http.Transport), http1: make(map[*http.Transport]*http.Transport), configHosts: endpointConfigHosts(configData)}
+	verifier.apply(u.base.TLSClientConfig)
+
+	// set up each endpoint
+	for _, host := range endpointConfigHosts(configData) {
+
+		// load the client cert
+		cert, err := loadClientCert(configData, host)
+		if err != nil {
+
+			// return the error
+			return nil, fmt.Errorf("the client certificate for %s couldn't be loaded: %s", host, err.Error())
+
+		}
+
+		// get how it is checked
+		endpointMode := getEndpointSetting(configData, host, "verify", "")
+		endpointBundle := getEndpointSetting(configData, host, "caBundle", "")
+		pins := getEndpointListSetting(configData, host, "pins")
+
+		// endpoints without anything to change use the base
+		if (cert == nil) && (endpointMode == "") && (endpointBundle == "") && (len(pins) == 0) {
+
+			// skip it
+			continue
+
+		}
+
+		// anything not set for the endpoint comes from every endpoint's settings
+		if (endpointMode == "") && (endpointBundle == "") {
+
+			// use them
+			endpointMode, endpointBundle = mode, bundle
+
+		}
+
+		// make the verifier
+		endpointVerifier, err := newUpstreamVerifier(host, endpointMode, endpointBundle, pins)
+		if err != nil {
+
+			// return the error
+			return nil, fmt.Errorf("the verify settings for %s are wrong: %s", host, err.Error())
+
+		}
+
+		// copy the base
+		transport := copyTransport(base)
+		endpointVerifier.apply(transport.TLSClientConfig)
+
+		// present the client cert
+		if cert != nil {
+
+			// add it
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+
+		}
+
+		// add it
+		u.endpoints[host] = transport
+
+	}
+
+	// send them through the upstream proxy
+	if err := u.applyProxies(configData); err != nil {
+
+		// return the error
+		return nil, err
+
+	}
+
+	// and let them use http/2
+	u.applyHTTP2(configData)
+
+	// and keep them from waiting forever
+	if err := u.applyCallPolicies(configData); err != nil {
+
+		// return the error
+		return nil, err
+
+	}
+
+	// return them
+	return u, nil
+
+}
+
+// get the key in endpointConfig that a host comes under, which is
+// what the settings for each endpoint are kept by
+func (u *upstreams) configKey(host string) string {
+
+	// find it
+	key, _ := matchHostKey(u.configHosts, host)
+	return key
+
+}
+
+// get the transport for a request to a host. this is the host
+// the console asked for, not the one it is redirected to
+func (u *upstreams) transport(host string) *http.Transport {
+
+	// check for one for the endpoint
+	if transport, ok := u.endpoints[u.configKey(host)]; ok {
+
+		// use it
+		return transport
+
+	}
+
+	// use the base
+	return u.base
+
+}
+
+// get the round tripper for goproxy to use for a host
+func (u *upstreams) roundTripper(host string) goproxy.RoundTripper {
+
+	// wrap it
+	return goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+
+		// send it
+		resp, err := u.send(host, req)
+		if err != nil {
+
+			// tell the console what went wrong
+			fmt.Printf("[err]: error while sending the request to %s: %s\n", req.URL.Host, err.Error())
+			return upstreamErrorResponse(req, err), nil
+
+		}
+
+		// log how it went
+		logProtocols(host, req.Proto, resp.Proto)
+
+		// return the response
+		return resp, nil
+
+	})
+
+}
@@ -0,0 +1,266 @@
+/*
+
+maryo/upstreamproxy.go
+
+sends maryo's own connections through another proxy, for
+networks that need one or to chain into a capture tool
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	// externals
+	"github.com/elazarl/goproxy"
+	"golang.org/x/net/proxy"
+)
+
+// parse an upstream proxy setting. an empty setting or "direct"
+// means no proxy, and gives nil
+func parseUpstreamProxy(value string) (*url.URL, error) {
+
+	// no proxy
+	if (value == "") || (value == "direct") {
+
+		// nothing
+		return nil, nil
+
+	}
+
+	// parse it
+	proxyURL, err := url.Parse(value)
+	if err != nil {
+
+		// return the error
+		return nil, err
+
+	}
+
+	// make sure it is a kind we can use
+	switch proxyURL.Scheme {
+
+	case "http", "https", "socks5", "socks5h":
+
+		// it is
+		if proxyURL.Host == "" {
+
+			// but there's no host
+			return nil, fmt.Errorf("%s has no host", value)
+
+		}
+		return proxyURL, nil
+
+	}
+
+	// it isn't
+	return nil, fmt.Errorf("%s is not an http, https, or socks5 proxy", value)
+
+}
+
+// make the func a transport uses to pick its proxy. hosts that
+// match noProxy are connected to directly
+func proxyFunc(proxyURL *url.URL, noProxy []string) func(*http.Request) (*url.URL, error) {
+
+	// pick the proxy for each request
+	return func(req *http.Request) (*url.URL, error) {
+
+		// connect directly if there is no proxy, or it is skipped
+		if (proxyURL == nil) || hostMatchesAny(noProxy, stripHostPort(req.URL.Host)) {
+
+			// no proxy
+			return nil, nil
+
+		}
+
+		// use the proxy
+		return proxyURL, nil
+
+	}
+
+}
+
+// plain http requests sent through an http proxy name the server
+// in the request line, and the proxy uses that instead of the host
+// header. go fills it in from the host header, so that has to be
+// the server the request was redirected to
+func setHostForProxy(transport *http.Transport, req *http.Request) {
+
+	// only plain http requests are sent like that
+	if (req.URL.Scheme != "http") || (transport.Proxy == nil) {
+
+		// nothing to do
+		return
+
+	}
+
+	// check if it goes through an http proxy
+	proxyURL, err := transport.Proxy(req)
+	if (err == nil) && (proxyURL != nil) && ((proxyURL.Scheme == "http") || (proxyURL.Scheme == "https")) {
+
+		// name the server
+		req.Host = req.URL.Host
+
+	}
+
+}
+
+// set the proxy on the transports from the settings in the config
+func (u *upstreams) applyProxies(configData map[string]interface{}) error {
+
+	// get the proxy for every endpoint
+	global, err := parseUpstreamProxy(getSetting(configData, "upstreamProxy", ""))
+	if err != nil {
+
+		// return the error
+		return fmt.Errorf("upstreamProxy is wrong: %s", err.Error())
+
+	}
+	noProxy := getListSetting(configData, "noProxy")
+
+	// only change the base if there is one, so the environment
+	// variables still work otherwise
+	if global != nil {
+
+		// set it
+		u.base.Proxy = proxyFunc(global, noProxy)
+		for _, transport := range u.endpoints {
+
+			// and on every endpoint's copy
+			transport.Proxy = u.base.Proxy
+
+		}
+
+	}
+
+	// set it for each endpoint that has its own
+	for _, host := range endpointConfigHosts(configData) {
+
+		// get it
+		setting := getEndpointSetting(configData, host, "proxy", "")
+		if setting == "" {
+
+			// it uses the base's
+			continue
+
+		}
+		endpointProxy, err := parseUpstreamProxy(setting)
+		if err != nil {
+
+			// return the error
+			return fmt.Errorf("the proxy for %s is wrong: %s", host, err.Error())
+
+		}
+
+		// make sure it has its own transport
+		transport, ok := u.endpoints[host]
+		if !ok {
+
+			// copy the base
+			transport = copyTransport(u.base)
+			u.endpoints[host] = transport
+
+		}
+
+		// set it
+		transport.Proxy = proxyFunc(endpointProxy, noProxy)
+
+	}
+
+	// no errors
+	return nil
+
+}
+
+// make the func goproxy uses to open connections it passes through,
+// so they go through the upstream proxy too. it is nil if there
+// isn't one, so goproxy keeps using the environment variables
+func connectDialFromConfig(configData map[string]interface{}, p *goproxy.ProxyHttpServer) (func(network, addr string) (net.Conn, error), error) {
+
+	// get the proxy
+	proxyURL, err := parseUpstreamProxy(getSetting(configData, "upstreamProxy", ""))
+	if (err != nil) || (proxyURL == nil) {
+
+		// there isn't one
+		return nil, err
+
+	}
+	noProxy := getListSetting(configData, "noProxy")
+
+	// get the username and password
+	user, password := "", ""
+	if proxyURL.User != nil {
+
+		// get them
+		user = proxyURL.User.Username()
+		password, _ = proxyURL.User.Password()
+
+	}
+
+	// make the dialer for the kind of proxy
+	var through func(network, addr string) (net.Conn, error)
+	switch proxyURL.Scheme {
+
+	case "http", "https":
+
+		// ask it to connect, logging in if we need to
+		through = p.NewConnectDialToProxyWithHandler(proxyURL.String(), func(req *http.Request) {
+
+			// add the login
+			if proxyURL.User != nil {
+
+				// add it
+				req.Header.Set("Proxy-Authorization", fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", user, password)))))
+
+			}
+
+		})
+
+	default:
+
+		// log in if we need to
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+
+			// add the login
+			auth = &proxy.Auth{User: user, Password: password}
+
+		}
+
+		// make the dialer
+		dialer, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, proxy.Direct)
+		if err != nil {
+
+			// return the error
+			return nil, err
+
+		}
+		through = dialer.Dial
+
+	}
+
+	// connect directly to hosts that skip the proxy
+	return func(network, addr string) (net.Conn, error) {
+
+		// check it
+		if hostMatchesAny(noProxy, stripHostPort(addr)) {
+
+			// connect directly
+			return net.Dial(network, addr)
+
+		}
+
+		// go through the proxy
+		return through(network, addr)
+
+	}, nil
+
+}
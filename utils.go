@@ -13,83 +13,147 @@ package main
 
 import (
 	// internals
-	"crypto/tls"
-	"crypto/x509"
 	"fmt"
-	"net"
 	"net/http"
 	"reflect"
 	// externals
 	"github.com/elazarl/goproxy"
 )
 
-// get the ip address of the machine
-func getIP() string {
+// get the ip address of the machine. preferred is the
+// interface name or ip from the config, if there is one
+func getIP(preferred string) string {
+
+	// list the addresses
+	addresses, err := listAddresses()
+
+	// handle errors, or having no network at all
+	if (err != nil) || (len(addresses) == 0) {
 
-	// dial a connection to another ip
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	
-	// handle errors
-	if err != nil {
-		
 		// show error message
-		fmt.Printf("[err]: error while connecting to another computer\n")
-		
-		// show traceback
-		panic(err)
-		
+		fmt.Printf("[err]: couldn't find a network address for this machine, using 127.0.0.1...\n")
+
+		// only this machine can connect, then
+		return "127.0.0.1"
+
 	}
-	
-	// close the connection once dobs
-	defer conn.Close()
 
-	// get the local address
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
+	// pick one
+	addr, ok := pickAddress(addresses, preferred)
+
+	// let the user know if their choice wasn't there
+	if ok == false {
+
+		// show error message
+		fmt.Printf("[err]: %s was not found, using %s instead...\n", preferred, addr.String())
+
+	}
 
 	// return it
-	return localAddr.IP.String()
-	
+	return addr.ip.String()
+
 }
 
-// setting CA in goproxy
-func setCA(caCert, caKey []byte) error {
+// get a setting from the config section of a config,
+// or a default value if it isn't set
+func getSetting(configData map[string]interface{}, name string, def string) string {
 
-	// get the keypair from cert and key data
-	goproxyCa, err := tls.X509KeyPair(caCert, caKey)
+	// get the config section
+	settings, ok := configData["config"].(map[string]interface{})
+	if !ok {
 
-	// handle error
-	if err != nil {
+		// use the default
+		return def
 
-		// return the error
-		return err
+	}
+
+	// get the setting
+	switch value := settings[name].(type) {
+
+	case string:
+
+		// return it as is
+		return value
+
+	case bool, float64:
+
+		// format it
+		return fmt.Sprintf("%v", value)
 
 	}
 
-	// again, handle errors
-	if goproxyCa.Leaf, err = x509.ParseCertificate(goproxyCa.Certificate[0]); err != nil {
+	// use the default
+	return def
+
+}
+
+// get a setting that is a list of strings from the config section,
+// or nothing if it isn't there
+func getListSetting(configData map[string]interface{}, name string) []string {
+
+	// get the config section
+	settings, ok := configData["config"].(map[string]interface{})
+	if !ok {
 
-		// return the error
-		return err
+		// there is nothing
+		return []string{}
 
 	}
 
-	// set the CA
-	goproxy.GoproxyCa = goproxyCa
+	// get the strings in it
+	return stringsOf(settings[name])
+
+}
+
+// get the strings out of a list from a json file
+func stringsOf(value interface{}) []string {
+
+	// list of values
+	values := []string{}
+
+	// make sure it is a list
+	list, ok := value.([]interface{})
+	if !ok {
+
+		// there is nothing
+		return values
+
+	}
+
+	// add each of the strings
+	for _, item := range list {
+
+		// skip anything that isn't one
+		if str, ok := item.(string); ok {
+
+			// add it
+			values = append(values, str)
+
+		}
+
+	}
+
+	// return them
+	return values
+
+}
+
+// setting CA in goproxy, signing certificates through the leaf cache.
+// goproxy.GoproxyCa is left alone, since it would still hold the old
+// CA after a renewal, and every action here signs with the cache's
+func setCA(cache *leafCache) {
 
 	// on connections, use it
-	goproxy.OkConnect = &goproxy.ConnectAction{Action: goproxy.ConnectAccept, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
+	goproxy.OkConnect = &goproxy.ConnectAction{Action: goproxy.ConnectAccept, TLSConfig: cache.tlsConfig}
 
 	// on MITMed connections, use it
-	goproxy.MitmConnect = &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
+	goproxy.MitmConnect = &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: cache.tlsConfig}
 
 	// on MITMed HTTP connections, use it
-	goproxy.HTTPMitmConnect = &goproxy.ConnectAction{Action: goproxy.ConnectHTTPMitm, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
+	goproxy.HTTPMitmConnect = &goproxy.ConnectAction{Action: goproxy.ConnectHTTPMitm, TLSConfig: cache.tlsConfig}
 
 	// on rejected connections, use it
-	goproxy.RejectConnect = &goproxy.ConnectAction{Action: goproxy.ConnectReject, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
-
-	// then return nil since there were no errors
-	return nil
+	goproxy.RejectConnect = &goproxy.ConnectAction{Action: goproxy.ConnectReject, TLSConfig: cache.tlsConfig}
 
 }
 
@@ -0,0 +1,347 @@
+/*
+
+maryo/verify.go
+
+checks the certificates upstream servers present, and
+explains what was wrong with them when they don't check out
+
+written by superwhiskers, licensed under gnu gplv3.
+if you want a copy, go to http://www.gnu.org/licenses/
+
+*/
+
+package main
+
+import (
+	// internals
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// the ways upstream certificates can be checked
+var verifyModes = map[string]string{
+	"none":     "don't check the chain",
+	"system":   "check the chain against the system's CAs",
+	"nintendo": "check the chain against nintendo's server CA (Nintendo CA - G3)",
+	"bundle":   "check the chain against the CAs in caBundle",
+}
+
+// where nintendo's server CA is kept. maryo can't ship it, so it
+// has to be dumped from a console
+const nintendoServerCAPath = "maryo-data/nintendo-ca-g3.pem"
+
+// metrics for upstream verification
+var upstreamVerifyFailures = newCounter("maryo_upstream_verify_failures_total", "upstream connections whose certificates didn't check out")
+
+// checks the certificates presented by one endpoint's servers
+type upstreamVerifier struct {
+	host  string
+	mode  string
+	roots *x509.CertPool
+	pins  []string
+}
+
+// get the spki pin of a cert, which is the base64 sha-256 of its public key
+func spkiPin(cert *x509.Certificate) string {
+
+	// hash the key
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	// encode it
+	return base64.StdEncoding.EncodeToString(sum[:])
+
+}
+
+// make the verifier for an endpoint. host is only used in messages,
+// and is empty for the one used by every endpoint
+func newUpstreamVerifier(host string, mode string, bundle string, pins []string) (*upstreamVerifier, error) {
+
+	// a ca bundle implies checking against it
+	if (mode == "") && (bundle != "") {
+
+		// use it
+		mode = "bundle"
+
+	}
+
+	// nothing means no checking
+	if mode == "" {
+
+		// like goproxy does
+		mode = "none"
+
+	}
+
+	// make sure the mode exists
+	if _, ok := verifyModes[mode]; !ok {
+
+		// it doesn't
+		return nil, fmt.Errorf("%s is not a verify mode (use none, system, nintendo, or bundle)", mode)
+
+	}
+
+	// make it
+	verifier := &upstreamVerifier{host: host, mode: mode}
+
+	// pins can be written with or without the sha256/ prefix
+	for _, pin := range pins {
+
+		// add it
+		verifier.pins = append(verifier.pins, strings.TrimPrefix(pin, "sha256/"))
+
+	}
+
+	// load what the mode needs
+	switch mode {
+
+	case "nintendo":
+
+		// nintendo's servers chain to its server CA, not the cert built into
+		// maryo, which is a client cert
+		roots, err := loadNintendoServerCA()
+		if err != nil {
+
+			// return the error
+			return nil, err
+
+		}
+		verifier.roots = roots
+
+	case "bundle":
+
+		// make sure there is one
+		if (bundle == "") || !doesFileExist(bundle) {
+
+			// there isn't
+			return nil, fmt.Errorf("the ca bundle \"%s\" does not exist", bundle)
+
+		}
+
+		// load it
+		verifier.roots = x509.NewCertPool()
+		if !verifier.roots.AppendCertsFromPEM(readFileByte(bundle)) {
+
+			// there were no certs in it
+			return nil, fmt.Errorf("there are no certificates in %s", bundle)
+
+		}
+
+	}
+
+	// return it
+	return verifier, nil
+
+}
+
+// check if the verifier does anything
+func (verifier *upstreamVerifier) active() bool {
+
+	// it does if it checks the chain or pins
+	return (verifier.mode != "none") || (len(verifier.pins) != 0)
+
+}
+
+// load nintendo's server CA, making sure it is one
+func loadNintendoServerCA() (*x509.CertPool, error) {
+
+	// make sure it is there
+	if !doesFileExist(nintendoServerCAPath) {
+
+		// it isn't
+		return nil, fmt.Errorf("the nintendo verify mode needs Nintendo CA - G3 at %s (dump it from your console)", nintendoServerCAPath)
+
+	}
+
+	// read the certs in it
+	roots := x509.NewCertPool()
+	data := readFileByte(nintendoServerCAPath)
+	found := false
+	for {
+
+		// get the next one
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+
+			// there are no more
+			break
+
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+
+			// it is wrong
+			return nil, fmt.Errorf("%s has a certificate that can't be read: %s", nintendoServerCAPath, err.Error())
+
+		}
+
+		// only CAs can sign the servers' certs
+		if !cert.IsCA {
+
+			// it isn't one
+			return nil, fmt.Errorf("%s (in %s) isn't a CA, it should be Nintendo CA - G3", cert.Subject.CommonName, nintendoServerCAPath)
+
+		}
+		roots.AddCert(cert)
+		found = true
+
+	}
+
+	// there has to be one
+	if !found {
+
+		// there wasn't
+		return nil, fmt.Errorf("there are no certificates in %s", nintendoServerCAPath)
+
+	}
+
+	// return them
+	return roots, nil
+
+}
+
+// describe a chain, for when it doesn't check out
+func describeChain(chain []*x509.Certificate) string {
+
+	// describe each cert
+	lines := []string{}
+	for x, cert := range chain {
+
+		// describe it
+		lines = append(lines, fmt.Sprintf("    %d: subject %s\n       issuer  %s\n       valid   %s to %s\n       sha-256 %s\n       spki    sha256/%s", x, cert.Subject.String(), cert.Issuer.String(), cert.NotBefore.Format("2006-01-02"), cert.NotAfter.Format("2006-01-02"), fingerprint(cert, false), spkiPin(cert)))
+
+	}
+
+	// join them
+	return strings.Join(lines, "\n")
+
+}
+
+// check a connection, for tls.Config.VerifyConnection
+func (verifier *upstreamVerifier) verifyConnection(state tls.ConnectionState) error {
+
+	// check it
+	err := verifier.check(state.PeerCertificates, state.ServerName)
+	if err != nil {
+
+		// servers reached by ip don't have a name
+		name := state.ServerName
+		if name == "" {
+
+			// call it something
+			name = "the server"
+
+		}
+
+		// name the endpoint if there is one
+		if (verifier.host != "") && (verifier.host != state.ServerName) {
+
+			// add it
+			name = fmt.Sprintf("%s for %s", name, verifier.host)
+
+		}
+
+		// explain it
+		upstreamVerifyFailures.add(1)
+		consoleSequence(fmt.Sprintf("-> %sthe certificate from %s didn't check out%s (%s): %s\n", code("red"), name, code("reset"), verifier.mode, err.Error()))
+		fmt.Printf("   it presented:\n%s\n", describeChain(state.PeerCertificates))
+		writeLog(fmt.Sprintf("-> the certificate from %s didn't check out (%s): %s\n   it presented:\n%s\n", name, verifier.mode, err.Error(), describeChain(state.PeerCertificates)))
+
+	}
+
+	// return the result
+	return err
+
+}
+
+// check the certificates a server presented. host is empty for
+// servers reached by ip, since go doesn't send their name, so
+// only the chain is checked for them
+func (verifier *upstreamVerifier) check(chain []*x509.Certificate, host string) error {
+
+	// there has to be something
+	if len(chain) == 0 {
+
+		// there isn't
+		return errors.New("the server didn't present a certificate")
+
+	}
+
+	// check the chain
+	switch verifier.mode {
+
+	case "system", "bundle", "nintendo":
+
+		// the rest of the chain are intermediates
+		intermediates := x509.NewCertPool()
+		for _, cert := range chain[1:] {
+
+			// add it
+			intermediates.AddCert(cert)
+
+		}
+
+		// verify it. roots is nil for the system ones
+		if _, err := chain[0].Verify(x509.VerifyOptions{DNSName: host, Roots: verifier.roots, Intermediates: intermediates}); err != nil {
+
+			// it didn't
+			return err
+
+		}
+
+	}
+
+	// check the pins
+	if len(verifier.pins) != 0 {
+
+		// any cert in the chain can match
+		for _, cert := range chain {
+
+			// check each pin
+			pin := spkiPin(cert)
+			for _, want := range verifier.pins {
+
+				// check it
+				if pin == want {
+
+					// it matches
+					return nil
+
+				}
+
+			}
+
+		}
+
+		// none of them matched
+		return errors.New("none of the certificates match the pinned keys")
+
+	}
+
+	// it checks out
+	return nil
+
+}
+
+// set up a tls config to use the verifier
+func (verifier *upstreamVerifier) apply(config *tls.Config) {
+
+	// the checks are done by hand, so go's own have to be skipped
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = nil
+
+	// check them ourselves if there is anything to check
+	if verifier.active() {
+
+		// check it
+		config.VerifyConnection = verifier.verifyConnection
+
+	}
+
+}